@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Roles of page passcodes. Owners can change everything, delete the page
+// and manage passcodes. Editors can only change the page content, and
+// appenders can only add to the end of it.
+const (
+	ROLE_OWNER    = "owner"
+	ROLE_EDITOR   = "editor"
+	ROLE_APPENDER = "appender"
+)
+
+var roles = []string{ROLE_OWNER, ROLE_EDITOR, ROLE_APPENDER}
+
+// Name recorded for changes made with the page passcode.
+const PAGE_PASSCODE_NAME = "owner"
+
+// Changes listed for owners on the edit page.
+const MAX_RECENT_CHANGES = 10
+
+// Passcode of a page. credential_id is 0 for the page passcode.
+type Credential struct {
+	credential_id int64
+	txtpage_id    int64
+	name          string
+	passcode      string
+	role          string
+	createdt      string
+}
+
+// Saved page version and the name of the passcode that saved it.
+type Change struct {
+	version  int64
+	createdt string
+	editor   string
+}
+
+// Passcode of the edit form, and for owners, the page's other passcodes
+// and recent changes.
+type AccessView struct {
+	cred    *Credential
+	creds   []Credential
+	changes []Change
+	notice  string
+}
+
+const CREDENTIAL_COLS = "credential_id, txtpage_id, name, passcode, role, createdt"
+
+func scan_credential(row RowScanner, c *Credential) error {
+	return row.Scan(&c.credential_id, &c.txtpage_id, &c.name, &c.passcode, &c.role, &c.createdt)
+}
+
+func is_role(role string) bool {
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the credential of tp with passcode, or nil if passcode is wrong.
+func find_credential(db *DB, tp *TxtPage, passcode string) *Credential {
+	if passcode == "" {
+		return nil
+	}
+	if passcode == tp.passcode {
+		return &Credential{
+			txtpage_id: tp.txtpage_id,
+			name:       PAGE_PASSCODE_NAME,
+			passcode:   tp.passcode,
+			role:       ROLE_OWNER,
+			createdt:   tp.createdt,
+		}
+	}
+	var c Credential
+	s := "SELECT " + CREDENTIAL_COLS + " FROM credential WHERE txtpage_id = ? AND passcode = ?"
+	err := scan_credential(sqlqueryrow(db, s, tp.txtpage_id, passcode), &c)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logerr("find_credential", err)
+		}
+		return nil
+	}
+	return &c
+}
+
+// Return the passcodes of page besides the page passcode, oldest first.
+func find_credentials(db *DB, txtpage_id int64) ([]Credential, Z) {
+	s := "SELECT " + CREDENTIAL_COLS + " FROM credential WHERE txtpage_id = ? ORDER BY credential_id"
+	rows, err := sqlquery(db, s, txtpage_id)
+	if err != nil {
+		logerr("find_credentials", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	cc := []Credential{}
+	for rows.Next() {
+		var c Credential
+		err := scan_credential(rows, &c)
+		if err != nil {
+			logerr("find_credentials", err)
+			return nil, Z_DBERR
+		}
+		cc = append(cc, c)
+	}
+	return cc, Z_OK
+}
+
+// Add passcode c to page tp, generating the passcode.
+func create_credential(db *DB, tp *TxtPage, c *Credential) Z {
+	c.txtpage_id = tp.txtpage_id
+	c.createdt = nowdate()
+	for c.passcode == "" || c.passcode == tp.passcode {
+		c.passcode = random_passcode() + "-" + random_passcode()
+	}
+	s := "INSERT INTO credential (txtpage_id, name, passcode, role, createdt) VALUES (?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, c.txtpage_id, c.name, c.passcode, c.role, c.createdt)
+	if err != nil {
+		logerr("create_credential", err)
+		return Z_DBERR
+	}
+	c.credential_id, _ = result.LastInsertId()
+	return Z_OK
+}
+
+func delete_credential(db *DB, credential_id int64, txtpage_id int64) Z {
+	_, err := sqlexec(db, "DELETE FROM credential WHERE credential_id = ? AND txtpage_id = ?", credential_id, txtpage_id)
+	if err != nil {
+		logerr("delete_credential", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func set_txtpage_passcode(db *DB, txtpage_id int64, passcode string) Z {
+	_, err := sqlexec(db, "UPDATE txtpage SET passcode = ? WHERE txtpage_id = ?", passcode, txtpage_id)
+	if err != nil {
+		logerr("set_txtpage_passcode", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func delete_txtpage(db *DB, txtpage_id int64) Z {
+	_, err := sqlexec(db, "DELETE FROM txtpage WHERE txtpage_id = ?", txtpage_id)
+	if err != nil {
+		logerr("delete_txtpage", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return the last MAX_RECENT_CHANGES saved versions of page, newest first.
+func find_recent_changes(db *DB, txtpage_id int64) ([]Change, Z) {
+	s := "SELECT version, createdt, editor FROM txtpage_revision WHERE txtpage_id = ? ORDER BY version DESC LIMIT ?"
+	rows, err := sqlquery(db, s, txtpage_id, MAX_RECENT_CHANGES)
+	if err != nil {
+		logerr("find_recent_changes", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		err := rows.Scan(&c.version, &c.createdt, &c.editor)
+		if err != nil {
+			logerr("find_recent_changes", err)
+			return nil, Z_DBERR
+		}
+		changes = append(changes, c)
+	}
+	return changes, Z_OK
+}
+
+// Return Z_OK if cred's role allows saving page saved as tp.
+func check_edit(cred *Credential, saved *TxtPage, tp *TxtPage) Z {
+	if cred == nil {
+		return Z_WRONG_PASSCODE
+	}
+	if cred.role == ROLE_OWNER {
+		return Z_OK
+	}
+	if tp.title != saved.title || sanitize_txtpage_url(tp.url) != saved.url || tp.desc != saved.desc || tp.author != saved.author ||
+		tp.tags != saved.tags || tp.searchable != saved.searchable || tp.listed != saved.listed || tp.toc != saved.toc || tp.view_password != saved.view_password || tp.max_views != saved.max_views || tp.expiry != saved.expiry {
+		return Z_CONTENT_ONLY
+	}
+	if cred.role == ROLE_APPENDER && !strings.HasPrefix(process_content(tp.content), saved.content) {
+		return Z_APPEND_ONLY
+	}
+	return Z_OK
+}
+
+func (server *Server) access_view(tp *TxtPage, cred *Credential, notice string) *AccessView {
+	av := AccessView{cred: cred, notice: notice}
+	if cred == nil || cred.role != ROLE_OWNER {
+		return &av
+	}
+	av.creds, _ = find_credentials(server.db, tp.txtpage_id)
+	av.changes, _ = find_recent_changes(server.db, tp.txtpage_id)
+	return &av
+}
+
+// Return the passcode management or delete button pressed on the edit form
+// and its credential id, or "" if none.
+func access_action(r *http.Request) (string, int64) {
+	for _, action := range []string{"add_credential", "revoke_credential", "reset_passcode", "delete_page"} {
+		v := r.FormValue(action)
+		if v != "" {
+			return action, int64(atoi(v))
+		}
+	}
+	return "", 0
+}
+
+// Add or revoke passcodes of tp, give it a new page passcode, or delete it,
+// from the edit form. Only owners can do these.
+func (server *Server) edit_access_handler(w http.ResponseWriter, r *http.Request, tp *TxtPage) {
+	var z Z
+	var fvalidate bool
+	var notice string
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	action, id := access_action(r)
+	passcode := strings.TrimSpace(r.FormValue("passcode"))
+	cred := find_credential(server.db, tp, passcode)
+
+	for {
+		if cred == nil {
+			fvalidate = true
+			break
+		}
+		if cred.role != ROLE_OWNER {
+			z = Z_OWNER_ONLY
+			fvalidate = true
+			break
+		}
+		if action == "add_credential" {
+			c := Credential{
+				name: strings.TrimSpace(r.FormValue("credential_name")),
+				role: r.FormValue("credential_role"),
+			}
+			if c.name == "" || !is_role(c.role) {
+				notice = "Enter a name and choose a role for the new passcode."
+				break
+			}
+			if strings.EqualFold(c.name, PAGE_PASSCODE_NAME) {
+				// Would look like changes made with the page passcode.
+				notice = fmt.Sprintf("The name %s is kept for the page passcode. Choose another name.", PAGE_PASSCODE_NAME)
+				break
+			}
+			z = create_credential(server.db, tp, &c)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			notice = fmt.Sprintf("Added %s passcode for %s: %s", c.role, c.name, c.passcode)
+		} else if action == "revoke_credential" {
+			z = delete_credential(server.db, id, tp.txtpage_id)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			notice = "Passcode revoked."
+		} else if action == "reset_passcode" {
+			newpasscode := random_passcode()
+			z = set_txtpage_passcode(server.db, tp.txtpage_id, newpasscode)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			if cred.credential_id == 0 {
+				passcode = newpasscode
+			}
+			tp.passcode = newpasscode
+			notice = fmt.Sprintf("The page passcode is now: %s", newpasscode)
+		} else if action == "delete_page" {
+			if r.FormValue("confirm_delete") == "" {
+				notice = "Check the box to confirm deleting the page."
+				break
+			}
+			z = delete_txtpage(server.db, tp.txtpage_id)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			server.gm.commit_page("delete", tp, "")
+			server.cache.invalidate(tp.url)
+			print_delete_page_success(P, r.Host, tp)
+			return
+		}
+		break
+	}
+
+	// The passcode may have just been revoked or replaced.
+	cred = find_credential(server.db, tp, passcode)
+	sv := server.suggestions_view(tp, cred, 0, "")
+	av := server.access_view(tp, cred, notice)
+	print_edit_page_form(P, r.Host, tp, action_href("edit", tp.url), fvalidate, z, passcode, nil, "", nil, sv, av, "")
+}
+
+func print_delete_page_success(P PrintFunc, host string, tp *TxtPage) {
+	html_print_open(P, host, &HtmlMeta{title: "TxtPage Deleted"})
+	print_header(P)
+	P("<h2>TxtPage deleted</h2>\n")
+	P("<p><b>%s</b> was deleted.</p>\n", escape(tp.title))
+	print_footer(P)
+	html_print_close(P)
+}
+
+// Notice about the passcode change just made, at the top of the edit form.
+func print_access_notice(P PrintFunc, av *AccessView) {
+	if av == nil || av.notice == "" {
+		return
+	}
+	P("    <div class=\"access_notice\">\n")
+	P("        <p>%s</p>\n", escape(av.notice))
+	P("    </div>\n")
+}
+
+// Passcodes, recent changes and delete button for owners, at the end of
+// the edit form.
+func print_form_access(P PrintFunc, tp *TxtPage, av *AccessView) {
+	if av == nil || av.cred == nil || av.cred.role != ROLE_OWNER {
+		return
+	}
+	P("    <div class=\"access\">\n")
+	P("        <h3>Passcodes</h3>\n")
+	P("        <p><i>Owners can change everything, manage passcodes and delete the page. Editors can only change the page content. Appenders can only add to the end of it.</i></p>\n")
+	P("        <table class=\"credentials\">\n")
+	P("            <tr><th>Name</th><th>Role</th><th>Passcode</th><th>Added</th><th></th></tr>\n")
+	P("            <tr><td>%s <i>(page passcode)</i></td><td>%s</td><td><code>%s</code></td><td>%s</td>", PAGE_PASSCODE_NAME, ROLE_OWNER, escape(tp.passcode), formatdate(tp.createdt))
+	P("<td><button type=\"submit\" name=\"reset_passcode\" value=\"1\">New passcode</button></td></tr>\n")
+	for _, c := range av.creds {
+		P("            <tr><td>%s</td><td>%s</td><td><code>%s</code></td><td>%s</td>", escape(c.name), c.role, escape(c.passcode), formatdate(c.createdt))
+		P("<td><button type=\"submit\" name=\"revoke_credential\" value=\"%d\">Revoke</button></td></tr>\n", c.credential_id)
+	}
+	P("        </table>\n")
+	P("        <p>\n")
+	P("            <label for=\"credential_name\">Add a passcode for</label>\n")
+	P("            <input id=\"credential_name\" name=\"credential_name\" placeholder=\"Name\">\n")
+	P("            <select name=\"credential_role\">\n")
+	for _, role := range roles {
+		P("                <option value=\"%s\">%s</option>\n", role, role)
+	}
+	P("            </select>\n")
+	P("            <button type=\"submit\" name=\"add_credential\" value=\"1\">Add passcode</button>\n")
+	P("        </p>\n")
+
+	if len(av.changes) > 0 {
+		P("        <h3>Recent changes</h3>\n")
+		P("        <ul class=\"recent_changes\">\n")
+		for _, c := range av.changes {
+			editor := c.editor
+			if editor == "" {
+				editor = "unknown"
+			}
+			P("            <li>Version %d on %s by <b>%s</b></li>\n", c.version, formatdate(c.createdt), escape(editor))
+		}
+		P("        </ul>\n")
+	}
+
+	P("        <h3>Delete page</h3>\n")
+	P("        <p>\n")
+	P("            <label><input type=\"checkbox\" name=\"confirm_delete\" value=\"1\"> Yes, delete this page and everything saved with it</label>\n")
+	P("            <button type=\"submit\" name=\"delete_page\" value=\"1\">Delete Page</button>\n")
+	P("        </p>\n")
+	P("    </div>\n")
+}
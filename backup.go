@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup snapshot filenames: txtpages-20060102T150405Z.db
+const BACKUP_PREFIX = "txtpages-"
+const BACKUP_EXT = ".db"
+const BACKUP_TIME_FMT = "20060102T150405Z"
+const CHECKSUM_EXT = ".sha256"
+
+const DEFAULT_KEEP_DAILY = 7
+const DEFAULT_KEEP_WEEKLY = 4
+
+type BackupFile struct {
+	file string
+	t    time.Time
+}
+
+// Write a consistent snapshot of db to destfile using VACUUM INTO, then
+// write its checksum file and verify the snapshot.
+// Safe to run while the server is writing to db.
+func backup_db(db *DB, destfile string) error {
+	if file_exists(destfile) {
+		return fmt.Errorf("File '%s' exists", destfile)
+	}
+	_, err := db.Exec("VACUUM INTO ?", destfile)
+	if err != nil {
+		return err
+	}
+	sum, err := file_checksum(destfile)
+	if err != nil {
+		return err
+	}
+	err = write_checksum_file(destfile, sum)
+	if err != nil {
+		return err
+	}
+	return verify_backup(destfile)
+}
+
+// Check backup file against its checksum file and run sqlite integrity check.
+func verify_backup(backupfile string) error {
+	want, err := read_checksum_file(backupfile)
+	if err != nil {
+		return err
+	}
+	sum, err := file_checksum(backupfile)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("'%s' checksum mismatch", backupfile)
+	}
+	return integrity_check_file(backupfile)
+}
+
+func integrity_check_file(dbfile string) error {
+	// Open read-only so verifying never modifies the file.
+	sqldb, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", dbfile))
+	if err != nil {
+		return err
+	}
+	defer sqldb.Close()
+
+	var result string
+	err = sqldb.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("'%s' failed integrity check: %s", dbfile, result)
+	}
+	return nil
+}
+
+func file_checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Checksum file is in sha256sum(1) format so it can also be checked with:
+// sha256sum -c <file>.sha256
+func write_checksum_file(file string, sum string) error {
+	s := fmt.Sprintf("%s  %s\n", sum, filepath.Base(file))
+	return os.WriteFile(file+CHECKSUM_EXT, []byte(s), 0644)
+}
+func read_checksum_file(file string) (string, error) {
+	bs, err := os.ReadFile(file + CHECKSUM_EXT)
+	if err != nil {
+		return "", err
+	}
+	ss := strings.Fields(string(bs))
+	if len(ss) == 0 {
+		return "", fmt.Errorf("'%s%s' is empty", file, CHECKSUM_EXT)
+	}
+	return ss[0], nil
+}
+
+// Restore verified backupfile to dbfile. Any existing dbfile is renamed to
+// dbfile.bak first. The server must not be running on dbfile.
+func restore_db(backupfile string, dbfile string) error {
+	err := check_db_bak(dbfile)
+	if err != nil {
+		return err
+	}
+	err = verify_backup(backupfile)
+	if err != nil {
+		return err
+	}
+
+	tmpfile := dbfile + ".restore"
+	err = copy_file(backupfile, tmpfile)
+	if err != nil {
+		return err
+	}
+	err = move_db_to_bak(dbfile)
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return os.Rename(tmpfile, dbfile)
+}
+
+// Return an error if restoring over dbfile would overwrite an earlier
+// dbfile.bak.
+func check_db_bak(dbfile string) error {
+	bakfile := dbfile + ".bak"
+	if file_exists(bakfile) || file_exists(bakfile+"-wal") {
+		return fmt.Errorf("'%s' already exists, move it away before restoring", bakfile)
+	}
+	return nil
+}
+
+// Rename dbfile to dbfile.bak along with its WAL files. The WAL can hold
+// committed transactions not yet in dbfile, which sqlite replays when
+// dbfile.bak is opened.
+func move_db_to_bak(dbfile string) error {
+	err := check_db_bak(dbfile)
+	if err != nil {
+		return err
+	}
+	if !file_exists(dbfile) {
+		// WAL files without their db can't be used.
+		os.Remove(dbfile + "-wal")
+		os.Remove(dbfile + "-shm")
+		return nil
+	}
+	bakfile := dbfile + ".bak"
+	for _, ext := range []string{"-wal", "-shm"} {
+		if !file_exists(dbfile + ext) {
+			continue
+		}
+		err = os.Rename(dbfile+ext, bakfile+ext)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(dbfile, bakfile)
+}
+
+func copy_file(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Write a new timestamped backup into backupdir and apply retention rules.
+func run_scheduled_backup(db *DB, backupdir string, keep_daily, keep_weekly int) error {
+	err := os.MkdirAll(backupdir, 0755)
+	if err != nil {
+		return err
+	}
+	filename := BACKUP_PREFIX + time.Now().UTC().Format(BACKUP_TIME_FMT) + BACKUP_EXT
+	destfile := filepath.Join(backupdir, filename)
+	err = backup_db(db, destfile)
+	if err != nil {
+		return err
+	}
+	logprint("Backed up db to %s\n", destfile)
+	return rotate_backups(backupdir, keep_daily, keep_weekly)
+}
+
+// Return backup snapshots in backupdir, newest first.
+func list_backups(backupdir string) ([]BackupFile, error) {
+	ff, err := filepath.Glob(filepath.Join(backupdir, BACKUP_PREFIX+"*"+BACKUP_EXT))
+	if err != nil {
+		return nil, err
+	}
+	bb := []BackupFile{}
+	for _, f := range ff {
+		ts := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), BACKUP_PREFIX), BACKUP_EXT)
+		t, err := time.Parse(BACKUP_TIME_FMT, ts)
+		if err != nil {
+			continue
+		}
+		bb = append(bb, BackupFile{file: f, t: t})
+	}
+	sort.Slice(bb, func(i, j int) bool {
+		return bb[i].t.After(bb[j].t)
+	})
+	return bb, nil
+}
+
+// Keep the newest backup of each of the last keep_daily days and the newest
+// backup of each of the last keep_weekly weeks. Delete the rest.
+func rotate_backups(backupdir string, keep_daily, keep_weekly int) error {
+	bb, err := list_backups(backupdir)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for _, b := range bb {
+		day := b.t.Format("2006-01-02")
+		if !days[day] && len(days) < keep_daily {
+			days[day] = true
+			keep[b.file] = true
+		}
+		year, wk := b.t.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, wk)
+		if !weeks[week] && len(weeks) < keep_weekly {
+			weeks[week] = true
+			keep[b.file] = true
+		}
+	}
+
+	for _, b := range bb {
+		if keep[b.file] {
+			continue
+		}
+		logprint("Removing old backup %s\n", b.file)
+		err = os.Remove(b.file)
+		if err != nil {
+			return err
+		}
+		os.Remove(b.file + CHECKSUM_EXT)
+	}
+	return nil
+}
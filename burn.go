@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Self-destructing pages are deleted after max_views views. A view is only
+// used up when the reader confirms the "this page will self-destruct"
+// screen, so link previews and crawlers fetching the url don't use them.
+
+// Largest view limit that can be set.
+const MAX_VIEW_LIMIT = 1000
+
+// Return max_views from the create or edit form, 0 for no limit.
+func form_max_views(r *http.Request) int64 {
+	switch r.FormValue("burn") {
+	case "once":
+		return 1
+	case "views":
+		n := int64(atoi(r.FormValue("max_views")))
+		if n < 1 {
+			n = 1
+		}
+		if n > MAX_VIEW_LIMIT {
+			n = MAX_VIEW_LIMIT
+		}
+		return n
+	}
+	return 0
+}
+
+// Use up a view of self-destructing page tp, and delete it after the last
+// one. Returns the views left, or Z_NOT_FOUND if there are none. Counting
+// and deleting are done in one write, so concurrent readers can't both get
+// the last view.
+func use_txtpage_view(db *DB, tp *TxtPage) (int64, Z) {
+	var left int64
+	err := db.write(func(tx *Tx) error {
+		s := "UPDATE txtpage SET views_left = views_left - 1 WHERE txtpage_id = ? AND max_views > 0 AND views_left > 0"
+		result, err := txexec(tx, s, tp.txtpage_id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return Z_NOT_FOUND
+		}
+		err = txqueryrow(tx, "SELECT views_left FROM txtpage WHERE txtpage_id = ?", tp.txtpage_id).Scan(&left)
+		if err != nil {
+			return err
+		}
+		if left > 0 {
+			return nil
+		}
+		_, err = txexec(tx, "DELETE FROM txtpage WHERE txtpage_id = ?", tp.txtpage_id)
+		return err
+	})
+	if err == Z_NOT_FOUND {
+		return 0, Z_NOT_FOUND
+	}
+	if err != nil {
+		logerr("use_txtpage_view", err)
+		return 0, Z_DBERR
+	}
+	tp.views_left = left
+	return left, Z_OK
+}
+
+// Return true if the request confirmed viewing self-destructing page tp
+// and got one of its views. Otherwise the confirmation screen is shown,
+// which posts back to the request url.
+func (server *Server) check_burn_view(w http.ResponseWriter, r *http.Request, tp *TxtPage) bool {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	P := makePrintFunc(w)
+
+	if r.Method != "POST" || r.FormValue("burn_confirm") == "" {
+		print_burn_confirm(P, r.Host, r.URL.RequestURI(), tp)
+		return false
+	}
+	left, z := use_txtpage_view(server.db, tp)
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Not Found", noindex: true})
+		print_header(P)
+		if z == Z_NOT_FOUND {
+			P("<p>This page has self-destructed.</p>\n")
+		} else {
+			P("<p>Error retrieving txtpage: %s</p>\n", z.Error())
+		}
+		html_print_close(P)
+		return false
+	}
+	if left == 0 {
+		server.gm.commit_page("delete", tp, "")
+		server.cache.invalidate(tp.url)
+	}
+	return true
+}
+
+// Return true if the request has a passcode for self-destructing page tp.
+// Otherwise a passcode form is shown instead of the edit form, so the
+// edit form can't be used to read the page without using up a view.
+func (server *Server) check_burn_edit(w http.ResponseWriter, r *http.Request, tp *TxtPage) bool {
+	if r.FormValue("section") != "" {
+		// Sections of self-destructing pages are edited in the full form.
+		http.Redirect(w, r, action_href("edit", tp.url), http.StatusSeeOther)
+		return false
+	}
+	passcode := strings.TrimSpace(r.FormValue("passcode"))
+	if r.Method == "POST" && find_credential(server.db, tp, passcode) != nil {
+		return true
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	P := makePrintFunc(w)
+	print_burn_edit_passcode_form(P, r.Host, action_href("edit", tp.url), passcode != "")
+	return false
+}
+
+func print_burn_confirm(P PrintFunc, host string, actionpath string, tp *TxtPage) {
+	html_print_open(P, host, &HtmlMeta{title: "Self-destructing page", noindex: true})
+	print_header(P)
+	P("<h2>This page will self-destruct</h2>\n")
+	if tp.views_left == 1 {
+		P("<p>This page will be deleted once you view it, and nobody will be able to see it again. Continue only if you're ready to read it now.</p>\n")
+	} else {
+		P("<p>This page can be viewed %d more times before it's deleted. Viewing it now uses up one of them.</p>\n", tp.views_left)
+	}
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", escape(actionpath))
+	P("    <input type=\"hidden\" name=\"burn_confirm\" value=\"1\">\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">View Page</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+func print_burn_edit_passcode_form(P PrintFunc, host string, actionpath string, wrong bool) {
+	html_print_open(P, host, &HtmlMeta{title: "Edit txtpage", noindex: true})
+	print_header(P)
+	P("<h2>Edit self-destructing page</h2>\n")
+	P("<p>Enter the page's passcode to edit it. Editing doesn't use up any views.</p>\n")
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", escape(actionpath))
+	P("    <input type=\"hidden\" name=\"burn_unlock\" value=\"1\">\n")
+	P("    <div>\n")
+	if wrong {
+		P("        <label for=\"passcode\">Incorrect passcode, please re-enter</label>\n")
+		P("        <input id=\"passcode\" class=\"highlight\" autofocus name=\"passcode\">\n")
+	} else {
+		P("        <label for=\"passcode\">Enter passcode</label>\n")
+		P("        <input id=\"passcode\" autofocus name=\"passcode\">\n")
+	}
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">Edit Page</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+// Notice above a self-destructing page after it was viewed.
+func print_burn_notice(P PrintFunc, tp *TxtPage) {
+	if tp.max_views == 0 {
+		return
+	}
+	P("<div class=\"burn_notice\">\n")
+	if tp.views_left == 0 {
+		P("    <p>This page has now been deleted and can't be viewed again. Copy anything you need before leaving.</p>\n")
+	} else if tp.views_left == 1 {
+		P("    <p>This page will be deleted after one more view.</p>\n")
+	} else {
+		P("    <p>This page will be deleted after %d more views.</p>\n", tp.views_left)
+	}
+	P("</div>\n")
+}
+
+// Self-destruct option of the create or edit form.
+func print_form_burn(P PrintFunc, tp *TxtPage) {
+	selected := func(b bool) string {
+		if b {
+			return " selected"
+		}
+		return ""
+	}
+	max_views := tp.max_views
+	if max_views < 2 {
+		max_views = 2
+	}
+	P("    <div>\n")
+	if tp.max_views > 0 && tp.txtpage_id != 0 {
+		P("        <label for=\"burn\">Self-destruct <i>(%d views left, changing the setting starts the count again)</i></label>\n", tp.views_left)
+	} else {
+		P("        <label for=\"burn\">Self-destruct <i>(optional, delete the page once it has been read)</i></label>\n")
+	}
+	P("        <select id=\"burn\" name=\"burn\">\n")
+	P("            <option value=\"\"%s>Never</option>\n", selected(tp.max_views == 0))
+	P("            <option value=\"once\"%s>Delete after the first view</option>\n", selected(tp.max_views == 1))
+	P("            <option value=\"views\"%s>Delete after this many views:</option>\n", selected(tp.max_views > 1))
+	P("        </select>\n")
+	P("        <input id=\"max_views\" name=\"max_views\" type=\"number\" min=\"1\" max=\"%d\" value=\"%d\" aria-label=\"Number of views\">\n", MAX_VIEW_LIMIT, max_views)
+	P("    </div>\n")
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Collection (book) of txtpages in reading order.
+// Collections are served under /book/<url>.
+type Collection struct {
+	collection_id int64
+	title         string
+	url           string
+	desc          string
+	passcode      string
+	createdt      string
+}
+
+// Position of a txtpage within a collection, for prev/next navigation.
+type BookNav struct {
+	book  *Collection
+	pages TxtPages
+	index int
+}
+
+const BOOK_PATH = "/book/"
+
+func book_href(c *Collection) string {
+	return BOOK_PATH + c.url
+}
+
+// Link to member page that keeps the collection navigation.
+func book_page_href(c *Collection, tp *TxtPage) string {
+	return fmt.Sprintf("/%s?book=%s", tp.url, qescape(c.url))
+}
+
+func find_collection_by_url(db *DB, url string, c *Collection) Z {
+	s := "SELECT collection_id, title, url, desc, passcode, createdt FROM collection WHERE url = ?"
+	row := sqlqueryrow(db, s, url)
+	err := row.Scan(&c.collection_id, &c.title, &c.url, &c.desc, &c.passcode, &c.createdt)
+	if err == sql.ErrNoRows {
+		return Z_NOT_FOUND
+	}
+	if err != nil {
+		logerr("find_collection_by_url", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return collections that txtpage belongs to, oldest first.
+func find_collections_by_txtpage(db *DB, txtpage_id int64) ([]*Collection, Z) {
+	s := "SELECT c.collection_id, c.title, c.url, c.desc, c.passcode, c.createdt FROM collection c INNER JOIN collection_page cp ON cp.collection_id = c.collection_id WHERE cp.txtpage_id = ? ORDER BY c.collection_id"
+	rows, err := sqlquery(db, s, txtpage_id)
+	if err != nil {
+		logerr("find_collections_by_txtpage", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	cc := []*Collection{}
+	for rows.Next() {
+		var c Collection
+		err := rows.Scan(&c.collection_id, &c.title, &c.url, &c.desc, &c.passcode, &c.createdt)
+		if err != nil {
+			logerr("find_collections_by_txtpage", err)
+			return nil, Z_DBERR
+		}
+		cc = append(cc, &c)
+	}
+	return cc, Z_OK
+}
+
+// Return member pages of collection in order.
+func find_collection_pages(db *DB, collection_id int64) (TxtPages, Z) {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE txtpage_id IN (SELECT txtpage_id FROM collection_page WHERE collection_id = ?) ORDER BY (SELECT seq FROM collection_page cp WHERE cp.collection_id = ? AND cp.txtpage_id = txtpage.txtpage_id)"
+	rows, err := sqlquery(db, s, collection_id, collection_id)
+	if err != nil {
+		logerr("find_collection_pages", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	tt := TxtPages{}
+	for rows.Next() {
+		var tp TxtPage
+		err := scan_txtpage(rows, &tp)
+		if err != nil {
+			logerr("find_collection_pages", err)
+			return nil, Z_DBERR
+		}
+		tt = append(tt, &tp)
+	}
+	return tt, Z_OK
+}
+
+func collection_url_exists(db *DB, url string, exclude_collection_id int64) bool {
+	s := "SELECT collection_id FROM collection WHERE url = ? AND collection_id <> ?"
+	row := sqlqueryrow(db, s, url, exclude_collection_id)
+	var tmpid int64
+	err := row.Scan(&tmpid)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		logerr("collection_url_exists", err)
+	}
+	return true
+}
+
+// Replace member pages of collection within tx.
+func txsave_collection_pages(tx *Tx, collection_id int64, pages TxtPages) error {
+	_, err := txexec(tx, "DELETE FROM collection_page WHERE collection_id = ?", collection_id)
+	if err != nil {
+		return err
+	}
+	for i, tp := range pages {
+		_, err = txexec(tx, "INSERT OR IGNORE INTO collection_page (collection_id, txtpage_id, seq) VALUES (?, ?, ?)", collection_id, tp.txtpage_id, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func create_collection(db *DB, c *Collection, pages TxtPages) Z {
+	if c.url != "" {
+		c.url = sanitize_url_segment(c.url)
+	}
+	if c.url != "" && collection_url_exists(db, c.url, 0) {
+		return Z_URL_EXISTS
+	}
+	if c.createdt == "" {
+		c.createdt = nowdate()
+	}
+	if c.passcode == "" {
+		c.passcode = random_passcode()
+	}
+
+	err := db.write(func(tx *Tx) error {
+		s := "INSERT INTO collection (title, url, desc, passcode, createdt) VALUES (?, ?, ?, ?, ?)"
+		result, err := txexec(tx, s, c.title, c.url, c.desc, c.passcode, c.createdt)
+		if err != nil {
+			return err
+		}
+		c.collection_id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if c.url == "" {
+			// Generate unique url if no url specified.
+			c.url = fmt.Sprintf("%s%d", sanitize_url_segment(c.title), c.collection_id)
+			_, err = txexec(tx, "UPDATE collection SET url = ? WHERE collection_id = ?", c.url, c.collection_id)
+			if err != nil {
+				return err
+			}
+		}
+		return txsave_collection_pages(tx, c.collection_id, pages)
+	})
+	if err != nil {
+		logerr("create_collection", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func edit_collection(db *DB, c *Collection, pages TxtPages, passcode string) Z {
+	if passcode != c.passcode {
+		return Z_WRONG_PASSCODE
+	}
+	if c.url != "" {
+		c.url = sanitize_url_segment(c.url)
+	}
+	if c.url == "" {
+		c.url = fmt.Sprintf("%s%d", sanitize_url_segment(c.title), c.collection_id)
+	}
+	if collection_url_exists(db, c.url, c.collection_id) {
+		return Z_URL_EXISTS
+	}
+
+	err := db.write(func(tx *Tx) error {
+		s := "UPDATE collection SET title = ?, url = ?, desc = ? WHERE collection_id = ?"
+		_, err := txexec(tx, s, c.title, c.url, c.desc, c.collection_id)
+		if err != nil {
+			return err
+		}
+		return txsave_collection_pages(tx, c.collection_id, pages)
+	})
+	if err != nil {
+		logerr("edit_collection", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return navigation of the collection named by bookurl for tp. Returns nil
+// if bookurl is empty or tp isn't in that collection. Anyone can add any
+// page to a book, so a book's nav is only shown on pages opened from it.
+func find_book_nav(db *DB, tp *TxtPage, bookurl string) *BookNav {
+	if bookurl == "" {
+		return nil
+	}
+	cc, z := find_collections_by_txtpage(db, tp.txtpage_id)
+	if z != Z_OK {
+		return nil
+	}
+	var c *Collection
+	for _, cand := range cc {
+		if cand.url == bookurl {
+			c = cand
+			break
+		}
+	}
+	if c == nil {
+		return nil
+	}
+	pages, z := find_collection_pages(db, c.collection_id)
+	if z != Z_OK {
+		return nil
+	}
+	pages = unexpired_txtpages(pages)
+	for i, p := range pages {
+		if p.txtpage_id == tp.txtpage_id {
+			return &BookNav{book: c, pages: pages, index: i}
+		}
+	}
+	return nil
+}
+
+// Member page urls, one per line. Full links to pages are accepted too.
+func parse_collection_page_urls(s string) []string {
+	urls := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "://") {
+			u, err := neturl.Parse(line)
+			if err == nil {
+				line = u.Path
+			}
+		}
+		line = strings.Trim(line, "/")
+		if line == "" {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls
+}
+
+// Look up member pages by url. Returns the urls not found.
+func find_txtpages_by_urls(db *DB, urls []string) (TxtPages, []string, Z) {
+	pages := TxtPages{}
+	notfound := []string{}
+	for _, url := range urls {
+		var tp TxtPage
+		z := find_txtpage_by_url(db, url, &tp)
+		if z == Z_NOT_FOUND {
+			notfound = append(notfound, url)
+			continue
+		}
+		if z != Z_OK {
+			return nil, nil, z
+		}
+		pages = append(pages, &tp)
+	}
+	return pages, notfound, Z_OK
+}
+
+func (server *Server) book_handler(w http.ResponseWriter, r *http.Request) {
+	var url string
+	var action string
+	ss := strings.Split(strings.TrimPrefix(r.URL.Path, BOOK_PATH), "/")
+	url = ss[0]
+	if len(ss) >= 2 {
+		action = ss[1]
+	}
+
+	if url == "" {
+		server.new_book_handler(w, r)
+	} else if action == "edit" {
+		server.edit_book_handler(w, r, url)
+	} else {
+		server.view_book_handler(w, r, url)
+	}
+}
+
+func (server *Server) view_book_handler(w http.ResponseWriter, r *http.Request, url string) {
+	var c Collection
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	z := find_collection_by_url(server.db, url, &c)
+	if z == Z_NOT_FOUND {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Book Not Found"})
+		print_header(P)
+		P("<p>Book not found: %s</p>\n", escape(url))
+		html_print_close(P)
+		return
+	}
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Book Error"})
+		print_header(P)
+		P("<p>Error retrieving book: %s</p>\n", z.Error())
+		html_print_close(P)
+		return
+	}
+	pages, z := find_collection_pages(server.db, c.collection_id)
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Book Error"})
+		print_header(P)
+		P("<p>Error retrieving book: %s</p>\n", z.Error())
+		html_print_close(P)
+		return
+	}
+	// Private and expired pages are left out so their headings aren't shown.
+	print_book(P, r.Host, &c, unexpired_txtpages(public_txtpages(pages)))
+}
+
+// Print collection as a combined table of contents of its pages.
+func print_book(P PrintFunc, host string, c *Collection, pages TxtPages) {
+	m := HtmlMeta{
+		title:       c.title,
+		description: c.desc,
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, host, &m)
+	P("<div class=\"titlebar header\">\n")
+	P("    <h1>%s</h1>\n", escape(c.title))
+	P("    <p><a href=\"%s/edit\">Edit</a></p>\n", book_href(c))
+	P("</div>\n")
+	if c.desc != "" {
+		P("<p>%s</p>\n", escape(c.desc))
+	}
+
+	gmd := create_goldmark_interface(nil)
+	P("<ol class=\"book_toc\">\n")
+	for _, tp := range pages {
+		pagehref := book_page_href(c, tp)
+		P("<li><a href=\"%s\">%s</a>\n", pagehref, escape(tp.title))
+
+		// Nest headings under the page, relative to the top heading level.
+		hh := md_headings(gmd, []byte(tp.content))
+		if len(hh) > 0 {
+			minlevel := hh[0].level
+			for _, h := range hh {
+				if h.level < minlevel {
+					minlevel = h.level
+				}
+			}
+			P("<ul>\n")
+			for _, h := range hh {
+				if h.level > minlevel+1 {
+					continue
+				}
+				P("<li class=\"book_toc_level%d\"><a href=\"%s#%s\">%s</a></li>\n", h.level-minlevel, pagehref, h.id, escape(h.text))
+			}
+			P("</ul>\n")
+		}
+		P("</li>\n")
+	}
+	P("</ol>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+// Print collection title and contents above a member page.
+func print_book_nav_top(P PrintFunc, bn *BookNav) {
+	if bn == nil {
+		return
+	}
+	P("<nav class=\"book_nav\">\n")
+	P("<details>\n")
+	P("<summary><a href=\"%s\">%s</a> - page %d of %d</summary>\n", book_href(bn.book), escape(bn.book.title), bn.index+1, len(bn.pages))
+	P("<ol>\n")
+	for i, tp := range bn.pages {
+		if i == bn.index {
+			P("<li><strong>%s</strong></li>\n", escape(txtpage_list_title(tp)))
+		} else {
+			P("<li><a href=\"%s\">%s</a></li>\n", book_page_href(bn.book, tp), escape(txtpage_list_title(tp)))
+		}
+	}
+	P("</ol>\n")
+	P("</details>\n")
+	P("</nav>\n")
+}
+
+// Print prev/next links below a member page.
+func print_book_nav_bottom(P PrintFunc, bn *BookNav) {
+	if bn == nil {
+		return
+	}
+	P("<nav class=\"titlebar book_pager\">\n")
+	if bn.index > 0 {
+		prev := bn.pages[bn.index-1]
+		P("    <p><a href=\"%s\" rel=\"prev\">&larr; %s</a></p>\n", book_page_href(bn.book, prev), escape(txtpage_list_title(prev)))
+	} else {
+		P("    <p><a href=\"%s\">&uarr; %s</a></p>\n", book_href(bn.book), escape(bn.book.title))
+	}
+	if bn.index < len(bn.pages)-1 {
+		next := bn.pages[bn.index+1]
+		P("    <p><a href=\"%s\" rel=\"next\">%s &rarr;</a></p>\n", book_page_href(bn.book, next), escape(txtpage_list_title(next)))
+	}
+	P("</nav>\n")
+}
+
+func (server *Server) new_book_handler(w http.ResponseWriter, r *http.Request) {
+	var z Z
+	var c Collection
+	var pageurls string
+	var notfound []string
+	var fvalidate bool
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	if r.Method == "POST" {
+		c.title = strings.TrimSpace(r.FormValue("title"))
+		c.desc = strings.TrimSpace(r.FormValue("desc"))
+		c.url = strings.TrimSpace(r.FormValue("url"))
+		c.passcode = strings.TrimSpace(r.FormValue("passcode"))
+		pageurls = strings.TrimSpace(r.FormValue("pages"))
+
+		for {
+			var pages TxtPages
+			pages, notfound, z = find_txtpages_by_urls(server.db, parse_collection_page_urls(pageurls))
+			if c.title == "" || len(pages) == 0 || len(notfound) > 0 || z != Z_OK {
+				fvalidate = true
+				break
+			}
+			z = create_collection(server.db, &c, pages)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			print_save_book_success(P, r.Host, &c)
+			return
+		}
+	}
+
+	print_book_form(P, r.Host, &c, pageurls, r.URL.Path, fvalidate, z, notfound, false, "")
+}
+
+func (server *Server) edit_book_handler(w http.ResponseWriter, r *http.Request, url string) {
+	var z Z
+	var c Collection
+	var pageurls string
+	var passcode string
+	var notfound []string
+	var fvalidate bool
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	z = find_collection_by_url(server.db, url, &c)
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Book Not Found"})
+		print_header(P)
+		P("<p>Error retrieving book: %s</p>\n", z.Error())
+		html_print_close(P)
+		return
+	}
+
+	if r.Method == "POST" {
+		c.title = strings.TrimSpace(r.FormValue("title"))
+		c.desc = strings.TrimSpace(r.FormValue("desc"))
+		c.url = strings.TrimSpace(r.FormValue("url"))
+		passcode = strings.TrimSpace(r.FormValue("passcode"))
+		pageurls = strings.TrimSpace(r.FormValue("pages"))
+
+		for {
+			var pages TxtPages
+			pages, notfound, z = find_txtpages_by_urls(server.db, parse_collection_page_urls(pageurls))
+			if c.title == "" || len(pages) == 0 || len(notfound) > 0 || z != Z_OK || passcode != c.passcode {
+				fvalidate = true
+				break
+			}
+			z = edit_collection(server.db, &c, pages, passcode)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			print_save_book_success(P, r.Host, &c)
+			return
+		}
+	} else {
+		pages, z := find_collection_pages(server.db, c.collection_id)
+		if z == Z_OK {
+			for _, tp := range pages {
+				pageurls += tp.url + "\n"
+			}
+		}
+	}
+
+	print_book_form(P, r.Host, &c, pageurls, r.URL.Path, fvalidate, z, notfound, true, passcode)
+}
+
+func print_book_form(P PrintFunc, host string, c *Collection, pageurls string, actionpath string, fvalidate bool, zresult Z, notfound []string, fedit bool, passcode string) {
+	var errmsg string
+
+	if fvalidate {
+		if zresult != Z_OK {
+			errmsg = zresult.Error()
+		}
+	}
+
+	title := "Create a book"
+	if fedit {
+		title = "Edit book"
+	}
+	m := HtmlMeta{
+		title:       title,
+		description: TXTPAGES_TITLE,
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, host, &m)
+	print_header(P)
+	P("<h2>%s</h2>\n", title)
+	P("<p>A book collects txtpages in reading order, with a table of contents and previous/next links on each page.</p>\n")
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", actionpath)
+	if errmsg != "" {
+		P("    <div class=\"txtpage_form_error\">\n")
+		P("        <p>%s</p>\n", errmsg)
+		P("    </div>\n")
+	}
+	P("    <div>\n")
+	if fvalidate && c.title == "" {
+		P("        <label for=\"title\">Please enter a Title</label>\n")
+		P("        <input id=\"title\" class=\"highlight\" autofocus name=\"title\" value=\"%s\">\n", escape(c.title))
+	} else {
+		P("        <label for=\"title\">Title</label>\n")
+		P("        <input id=\"title\" name=\"title\" value=\"%s\">\n", escape(c.title))
+	}
+	P("    </div>\n")
+	P("    <div>\n")
+	if fvalidate && len(notfound) > 0 {
+		P("        <label for=\"pages\">Pages not found: %s</label>\n", escape(strings.Join(notfound, ", ")))
+		P("        <textarea id=\"pages\" name=\"pages\" rows=\"10\" class=\"highlight\" autofocus>%s</textarea>\n", escape(pageurls))
+	} else if fvalidate && pageurls == "" {
+		P("        <label for=\"pages\">Please enter at least one page</label>\n")
+		P("        <textarea id=\"pages\" name=\"pages\" rows=\"10\" class=\"highlight\" autofocus>%s</textarea>\n", escape(pageurls))
+	} else {
+		P("        <label for=\"pages\">Pages <i>(one page URL per line, in reading order)</i></label>\n")
+		P("        <textarea id=\"pages\" name=\"pages\" rows=\"10\">%s</textarea>\n", escape(pageurls))
+	}
+	P("    </div>\n")
+	P("    <div>\n")
+	P("        <label for=\"desc\">Description <i>(optional)</i></label>\n")
+	P("        <textarea id=\"desc\" name=\"desc\" rows=\"3\">%s</textarea>\n", escape(c.desc))
+	P("    </div>\n")
+	P("    <div>\n")
+	if fvalidate && zresult == Z_URL_EXISTS {
+		P("        <label for=\"url\">URL already exists, enter another one</label>\n")
+		P("        <input id=\"url\" class=\"highlight\" name=\"url\" autofocus value=\"%s\">\n", escape(c.url))
+	} else {
+		P("        <label for=\"url\">Set URL <i>(optional)</i></label>\n")
+		P("        <input id=\"url\" name=\"url\" value=\"%s\">\n", escape(c.url))
+	}
+	P("    </div>\n")
+	P("    <div>\n")
+	if !fedit {
+		P("        <label for=\"passcode\">Set passcode <i>(optional)</i></label>\n")
+		P("        <input id=\"passcode\" name=\"passcode\" value=\"%s\">\n", escape(c.passcode))
+	} else if fvalidate && passcode != c.passcode {
+		P("        <label for=\"passcode\">Incorrect passcode, please re-enter</label>\n")
+		P("        <input id=\"passcode\" class=\"highlight\" autofocus name=\"passcode\" value=\"%s\">\n", escape(passcode))
+	} else {
+		P("        <label for=\"passcode\">Enter passcode</label>\n")
+		P("        <input id=\"passcode\" name=\"passcode\" value=\"%s\">\n", escape(passcode))
+	}
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	if fedit {
+		P("        <button type=\"submit\">Save Book</button>\n")
+	} else {
+		P("        <button type=\"submit\">Create Book</button>\n")
+	}
+	P("    </div>\n")
+	P("</form>\n")
+	html_print_close(P)
+}
+
+func print_save_book_success(P PrintFunc, host string, c *Collection) {
+	href_link := book_href(c)
+	edit_href_link := fmt.Sprintf("%s/edit", book_href(c))
+
+	html_print_open(P, host, &HtmlMeta{title: "Book Saved"})
+	P("<h2>Book saved!</h2>\n")
+	P("<p>Link to your book:<br>\n")
+	P("<a href=\"%s\">%s%s</a></p>", href_link, host, href_link)
+	P("<p>Edit your book:<br>\n")
+	P("<a href=\"%s\">%s%s</a></p>", edit_href_link, host, edit_href_link)
+	P("<p>Passcode: <strong><i>%s</i></strong></p>\n", escape(c.passcode))
+	P("<p>Memorize or write down your passcode and keep it somewhere safe.<br>You will need this when making changes to your book.</p>\n")
+	print_footer(P)
+	html_print_close(P)
+}
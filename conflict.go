@@ -0,0 +1,54 @@
+package main
+
+// Edit that was saved over by someone else, with the saved page content and
+// the two merged.
+type EditConflict struct {
+	mine   string
+	theirs string
+	merged string
+	clean  bool
+}
+
+// Merge the edited content in tp, made from tp.version, with the saved page.
+// tp.content is set to the merged content and tp.version to the saved
+// version, so saving the merged page again goes through.
+func (server *Server) merge_edit(tp *TxtPage) *EditConflict {
+	var saved TxtPage
+	z := find_txtpage_by_id(server.db, tp.txtpage_id, &saved)
+	if z != Z_OK {
+		return nil
+	}
+	if unlock_txtpage(&saved, tp.key) != nil {
+		return nil
+	}
+
+	// If the base revision is no longer kept, all changes conflict.
+	base, _ := find_txtpage_revision(server.db, tp, tp.version)
+	merged, clean := merge3(base, tp.content, saved.content)
+
+	c := EditConflict{mine: tp.content, theirs: saved.content, merged: merged, clean: clean}
+	tp.content = merged
+	tp.version = saved.version
+	return &c
+}
+
+func print_edit_conflict(P PrintFunc, c *EditConflict) {
+	if c == nil {
+		return
+	}
+	P("    <div class=\"edit_conflict\">\n")
+	if c.clean {
+		P("        <p>Someone else saved this page while you were editing it. Their changes were merged with yours below. Check the result and save again.</p>\n")
+	} else {
+		P("        <p>Someone else saved this page while you were editing it, and some of their changes conflict with yours. Below, each conflict shows your text between <code>%s</code> and <code>%s</code>, then their text up to <code>%s</code>. Keep the text you want, remove the markers and save again.</p>\n", escape(MERGE_MARK_MINE), MERGE_MARK_SEP, escape(MERGE_MARK_THEIRS))
+	}
+	P("        <details>\n")
+	P("            <summary>Their saved version</summary>\n")
+	P("            <textarea rows=\"10\" readonly>%s</textarea>\n", escape(c.theirs))
+	P("        </details>\n")
+	P("        <details>\n")
+	P("            <summary>Your version</summary>\n")
+	P("            <textarea rows=\"10\" readonly>%s</textarea>\n", escape(c.mine))
+	P("        </details>\n")
+	P("    </div>\n")
+}
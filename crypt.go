@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt cost parameters for keys derived from passwords.
+const SCRYPT_N = 32768
+const SCRYPT_R = 8
+const SCRYPT_P = 1
+
+// scrypt runs allowed at the same time. Each one takes 128*N*r bytes
+// (32 MiB), so this bounds the memory and cpu password checks can take.
+// Others wait for a free slot.
+const MAX_SCRYPTS = 4
+
+var scrypt_slots = make(chan struct{}, MAX_SCRYPTS)
+
+// Prefix of text encrypted by encrypt_text().
+const ENCRYPTED_PREFIX = "enc1:"
+
+var errDecrypt = errors.New("cannot decrypt")
+
+// Derive a 32 byte AES key and a 32 byte password check from password.
+func derive_key(password string, salt []byte, n, r, p int) ([]byte, []byte, error) {
+	scrypt_slots <- struct{}{}
+	defer func() { <-scrypt_slots }()
+	dk, err := scrypt.Key([]byte(password), salt, n, r, p, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk[:32], dk[32:], nil
+}
+
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt and authenticate plaintext and additional data ad with AES-GCM.
+// The random nonce is prepended to the result.
+func seal(key []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// Decrypt the result of seal(). Fails if key or ad are wrong or sealed
+// was modified.
+func unseal(key []byte, sealed []byte, ad []byte) ([]byte, error) {
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce, ct := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, ad)
+}
+
+// Return s encrypted with key, as text for storing in a TEXT column.
+func encrypt_text(key []byte, s string) (string, error) {
+	bs, err := seal(key, []byte(s), nil)
+	if err != nil {
+		return "", err
+	}
+	return ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(bs), nil
+}
+
+// Decrypt text from encrypt_text().
+func decrypt_text(key []byte, s string) (string, error) {
+	if !strings.HasPrefix(s, ENCRYPTED_PREFIX) {
+		return "", errDecrypt
+	}
+	bs, err := base64.StdEncoding.DecodeString(s[len(ENCRYPTED_PREFIX):])
+	if err != nil {
+		return "", errDecrypt
+	}
+	bs, err = unseal(key, bs, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
@@ -2,31 +2,238 @@ package main
 
 import (
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
-func sqlstmt(db *sql.DB, s string) *sql.Stmt {
-	stmt, err := db.Prepare(s)
+// DB wraps sql.DB with a cache of prepared statements and a single writer
+// goroutine. All writes go through DB.write() so they are serialized and
+// never contend with each other for the sqlite write lock.
+type DB struct {
+	*sql.DB
+
+	stmts_mu sync.Mutex
+	stmts    map[string]*sql.Stmt
+
+	wch   chan *DBWrite
+	wdone chan struct{}
+
+	// Called on the writer goroutine after every committed write.
+	on_commit func()
+}
+
+// Tx is a write transaction run by the writer goroutine.
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+type DBWrite struct {
+	fn        func(tx *Tx) error
+	exclusive func() error
+	errch     chan error
+}
+
+// Milliseconds sqlite waits on a locked db before returning SQLITE_BUSY.
+const DB_BUSY_TIMEOUT = 5000
+
+// Number of times to retry an operation that failed with SQLITE_BUSY.
+const DB_BUSY_RETRIES = 5
+const DB_BUSY_BACKOFF = 100 * time.Millisecond
+
+const DB_WRITE_QUEUE_LEN = 100
+
+// Open sqlite db file in WAL mode and start the writer goroutine.
+func open_db(dbfile string) (*DB, error) {
+	return open_db_driver("sqlite3", dbfile)
+}
+
+func open_db_driver(driver string, dbfile string) (*DB, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", dbfile, DB_BUSY_TIMEOUT)
+	sqldb, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = sqldb.Ping()
 	if err != nil {
-		log.Fatalf("db.Prepare() sql: '%s'\nerror: '%s'", s, err)
+		sqldb.Close()
+		return nil, err
+	}
+
+	db := &DB{
+		DB:    sqldb,
+		stmts: map[string]*sql.Stmt{},
+		wch:   make(chan *DBWrite, DB_WRITE_QUEUE_LEN),
+		wdone: make(chan struct{}),
 	}
-	return stmt
+	go db.run_writer()
+	return db, nil
 }
-func sqlexec(db *sql.DB, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := sqlstmt(db, s)
-	defer stmt.Close()
-	return stmt.Exec(pp...)
+
+// Stop the writer goroutine after pending writes are done and close the db.
+func (db *DB) close() error {
+	close(db.wch)
+	<-db.wdone
+
+	db.stmts_mu.Lock()
+	for _, stmt := range db.stmts {
+		stmt.Close()
+	}
+	db.stmts = map[string]*sql.Stmt{}
+	db.stmts_mu.Unlock()
+
+	return db.DB.Close()
+}
+
+func (db *DB) run_writer() {
+	for w := range db.wch {
+		if w.exclusive != nil {
+			w.errch <- w.exclusive()
+			continue
+		}
+		err := with_busy_retry(func() error {
+			return db.run_write_tx(w.fn)
+		})
+		if err == nil && db.on_commit != nil {
+			db.on_commit()
+		}
+		w.errch <- err
+	}
+	close(db.wdone)
+}
+
+func (db *DB) run_write_tx(fn func(tx *Tx) error) error {
+	sqltx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(&Tx{sqltx, db})
+	if err != nil {
+		sqltx.Rollback()
+		return err
+	}
+	return sqltx.Commit()
+}
+
+// Run fn inside a write transaction on the writer goroutine and wait for it
+// to finish. The transaction is rolled back if fn returns an error, and the
+// whole transaction is retried if sqlite reports the db as busy.
+func (db *DB) write(fn func(tx *Tx) error) error {
+	w := DBWrite{fn: fn, errch: make(chan error, 1)}
+	db.wch <- &w
+	return <-w.errch
+}
+
+// Run fn on the writer goroutine, outside of any transaction. No other
+// writes happen while fn runs.
+func (db *DB) exclusive(fn func() error) error {
+	w := DBWrite{exclusive: fn, errch: make(chan error, 1)}
+	db.wch <- &w
+	return <-w.errch
+}
+
+func is_busy_err(err error) bool {
+	var sqlerr sqlite3.Error
+	if errors.As(err, &sqlerr) {
+		return sqlerr.Code == sqlite3.ErrBusy || sqlerr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// Return true if err is a UNIQUE constraint violation.
+func is_unique_err(err error) bool {
+	var sqlerr sqlite3.Error
+	if errors.As(err, &sqlerr) {
+		return sqlerr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+func with_busy_retry(fn func() error) error {
+	var err error
+	for i := 0; i <= DB_BUSY_RETRIES; i++ {
+		err = fn()
+		if !is_busy_err(err) {
+			return err
+		}
+		time.Sleep(DB_BUSY_BACKOFF * time.Duration(i+1))
+	}
+	return err
+}
+
+// Return cached prepared statement for s, preparing it on first use.
+func sqlstmt(db *DB, s string) (*sql.Stmt, error) {
+	db.stmts_mu.Lock()
+	defer db.stmts_mu.Unlock()
+
+	stmt, ok := db.stmts[s]
+	if ok {
+		return stmt, nil
+	}
+	err := with_busy_retry(func() error {
+		var err error
+		stmt, err = db.Prepare(s)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare() sql: '%s' (%w)", s, err)
+	}
+	db.stmts[s] = stmt
+	return stmt, nil
+}
+func sqlexec(db *DB, s string, pp ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := db.write(func(tx *Tx) error {
+		var err error
+		result, err = txexec(tx, s, pp...)
+		return err
+	})
+	return result, err
+}
+func sqlquery(db *DB, s string, pp ...interface{}) (*sql.Rows, error) {
+	stmt, err := sqlstmt(db, s)
+	if err != nil {
+		return nil, err
+	}
+	var rows *sql.Rows
+	err = with_busy_retry(func() error {
+		var err error
+		rows, err = stmt.Query(pp...)
+		return err
+	})
+	return rows, err
 }
-func txstmt(tx *sql.Tx, s string) *sql.Stmt {
-	stmt, err := tx.Prepare(s)
+func sqlqueryrow(db *DB, s string, pp ...interface{}) *sql.Row {
+	stmt, err := sqlstmt(db, s)
 	if err != nil {
-		log.Fatalf("tx.Prepare() sql: '%s'\nerror: '%s'", s, err)
+		// Let the error surface in Row.Scan().
+		return db.QueryRow(s, pp...)
 	}
-	return stmt
+	return stmt.QueryRow(pp...)
 }
-func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := txstmt(tx, s)
-	defer stmt.Close()
+func txstmt(tx *Tx, s string) (*sql.Stmt, error) {
+	stmt, err := sqlstmt(tx.db, s)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(stmt), nil
+}
+func txexec(tx *Tx, s string, pp ...interface{}) (sql.Result, error) {
+	stmt, err := txstmt(tx, s)
+	if err != nil {
+		return nil, err
+	}
 	return stmt.Exec(pp...)
 }
+func txqueryrow(tx *Tx, s string, pp ...interface{}) *sql.Row {
+	stmt, err := txstmt(tx, s)
+	if err != nil {
+		// Let the error surface in Row.Scan().
+		return tx.QueryRow(s, pp...)
+	}
+	return stmt.QueryRow(pp...)
+}
@@ -21,6 +21,31 @@ type TxtPage struct {
 	passcode   string
 	createdt   string
 	lastreaddt string
+	views      int64
+	searchable bool
+	listed     bool
+	toc        bool
+	version    int64
+	tags       string
+
+	// Hash of the password needed to read the page, or "" if public.
+	view_password string
+
+	// Title and content are encrypted with the key derived from the view
+	// password. key is set once the page is unlocked, and isn't stored.
+	encrypted bool
+	key       []byte
+
+	// Views before the page self-destructs, or 0 for no limit, and the
+	// views it has left.
+	max_views  int64
+	views_left int64
+
+	// Expiry policy, the time timed policies expire at, and whether the
+	// admin pinned the page so it never expires.
+	expiry    string
+	expiresdt string
+	pinned    bool
 }
 
 type TxtPages []*TxtPage
@@ -33,8 +58,223 @@ const (
 	Z_URL_EXISTS
 	Z_NOT_FOUND
 	Z_WRONG_PASSCODE
+	Z_EDIT_CONFLICT
+	Z_OWNER_ONLY
+	Z_CONTENT_ONLY
+	Z_APPEND_ONLY
 )
 
+// Revisions of page content kept for merging simultaneous edits.
+const MAX_REVISIONS = 100
+
+// Columns read by scan_txtpage(), in order.
+const TXTPAGE_COLS = "txtpage_id, title, url, content, desc, author, passcode, createdt, lastreaddt, views, searchable, listed, tags, toc, version, view_password, encrypted, max_views, views_left, expiry, expiresdt, pinned"
+
+// Schema changes made after the initial tables. Migrations are applied in
+// order and the number applied is kept in the db's user_version pragma.
+// Only ever append to this list.
+var migrations = []string{
+	"ALTER TABLE txtpage ADD COLUMN views INTEGER NOT NULL DEFAULT 0",
+
+	// Full-text search index, kept in sync with txtpage by triggers.
+	"ALTER TABLE txtpage ADD COLUMN searchable INTEGER NOT NULL DEFAULT 1",
+	"CREATE VIRTUAL TABLE txtpage_fts USING fts5(title, desc, author, content, content='txtpage', content_rowid='txtpage_id')",
+	`CREATE TRIGGER txtpage_fts_insert AFTER INSERT ON txtpage BEGIN
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, new.title, new.desc, new.author, new.content);
+END`,
+	`CREATE TRIGGER txtpage_fts_delete AFTER DELETE ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, old.title, old.desc, old.author, old.content);
+END`,
+	`CREATE TRIGGER txtpage_fts_update AFTER UPDATE OF title, desc, author, content ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, old.title, old.desc, old.author, old.content);
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, new.title, new.desc, new.author, new.content);
+END`,
+	"INSERT INTO txtpage_fts (txtpage_fts) VALUES ('rebuild')",
+
+	// Pages opted into the public directory.
+	"ALTER TABLE txtpage ADD COLUMN listed INTEGER NOT NULL DEFAULT 0",
+
+	// Tags entered in the page form, and all tags of each page including
+	// #hashtags in content.
+	"ALTER TABLE txtpage ADD COLUMN tags TEXT NOT NULL DEFAULT ''",
+	`CREATE TABLE txtpage_tag (
+	txtpage_id INTEGER NOT NULL,
+	tag TEXT NOT NULL,
+	PRIMARY KEY (txtpage_id, tag)
+)`,
+	"CREATE INDEX txtpage_tag_tag ON txtpage_tag (tag)",
+	`CREATE TRIGGER txtpage_tag_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM txtpage_tag WHERE txtpage_id = old.txtpage_id;
+END`,
+
+	// Collections (books) of pages in reading order.
+	`CREATE TABLE collection (
+	collection_id INTEGER PRIMARY KEY NOT NULL,
+	title TEXT NOT NULL DEFAULT '',
+	url TEXT UNIQUE NOT NULL,
+	desc TEXT NOT NULL DEFAULT '',
+	passcode TEXT NOT NULL DEFAULT '',
+	createdt TEXT NOT NULL
+)`,
+	`CREATE TABLE collection_page (
+	collection_id INTEGER NOT NULL,
+	txtpage_id INTEGER NOT NULL,
+	seq INTEGER NOT NULL,
+	PRIMARY KEY (collection_id, txtpage_id)
+)`,
+	"CREATE INDEX collection_page_txtpage ON collection_page (txtpage_id)",
+	`CREATE TRIGGER collection_page_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM collection_page WHERE txtpage_id = old.txtpage_id;
+END`,
+
+	// Wiki links between pages. Links are kept by target url so links to
+	// pages not created yet become backlinks once the page exists.
+	`CREATE TABLE txtpage_link (
+	txtpage_id INTEGER NOT NULL,
+	target_url TEXT NOT NULL,
+	PRIMARY KEY (txtpage_id, target_url)
+)`,
+	"CREATE INDEX txtpage_link_target_url ON txtpage_link (target_url)",
+	`CREATE TRIGGER txtpage_link_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM txtpage_link WHERE txtpage_id = old.txtpage_id;
+END`,
+
+	// Show table of contents at the top of the page.
+	"ALTER TABLE txtpage ADD COLUMN toc INTEGER NOT NULL DEFAULT 0",
+
+	// Version counter for detecting simultaneous edits, and recent revisions
+	// of page content to use as the base when merging them.
+	"ALTER TABLE txtpage ADD COLUMN version INTEGER NOT NULL DEFAULT 1",
+	`CREATE TABLE txtpage_revision (
+	txtpage_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	content TEXT NOT NULL DEFAULT '',
+	createdt TEXT NOT NULL,
+	PRIMARY KEY (txtpage_id, version)
+)`,
+	`CREATE TRIGGER txtpage_revision_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM txtpage_revision WHERE txtpage_id = old.txtpage_id;
+END`,
+	"INSERT INTO txtpage_revision (txtpage_id, version, content, createdt) SELECT txtpage_id, version, content, lastreaddt FROM txtpage",
+
+	// Unsaved create and edit forms, per browser draft token. page is the
+	// url of the edited page, or '' for a new page.
+	`CREATE TABLE draft (
+	token TEXT NOT NULL,
+	page TEXT NOT NULL DEFAULT '',
+	title TEXT NOT NULL DEFAULT '',
+	content TEXT NOT NULL DEFAULT '',
+	desc TEXT NOT NULL DEFAULT '',
+	author TEXT NOT NULL DEFAULT '',
+	url TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '',
+	searchable INTEGER NOT NULL DEFAULT 1,
+	listed INTEGER NOT NULL DEFAULT 0,
+	toc INTEGER NOT NULL DEFAULT 0,
+	version INTEGER NOT NULL DEFAULT 0,
+	updatedt TEXT NOT NULL,
+	PRIMARY KEY (token, page)
+)`,
+	"CREATE INDEX draft_updatedt ON draft (updatedt)",
+
+	// Edits suggested by readers without the passcode, from page version.
+	`CREATE TABLE suggestion (
+	suggestion_id INTEGER PRIMARY KEY NOT NULL,
+	txtpage_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	content TEXT NOT NULL DEFAULT '',
+	author TEXT NOT NULL DEFAULT '',
+	note TEXT NOT NULL DEFAULT '',
+	createdt TEXT NOT NULL
+)`,
+	"CREATE INDEX suggestion_txtpage ON suggestion (txtpage_id)",
+	`CREATE TRIGGER suggestion_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM suggestion WHERE txtpage_id = old.txtpage_id;
+END`,
+
+	// Extra passcodes of a page, each with a role. The page passcode is
+	// the original owner's. Revisions record the passcode name that made
+	// them.
+	`CREATE TABLE credential (
+	credential_id INTEGER PRIMARY KEY NOT NULL,
+	txtpage_id INTEGER NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	passcode TEXT NOT NULL,
+	role TEXT NOT NULL,
+	createdt TEXT NOT NULL,
+	UNIQUE (txtpage_id, passcode)
+)`,
+	`CREATE TRIGGER credential_delete AFTER DELETE ON txtpage BEGIN
+	DELETE FROM credential WHERE txtpage_id = old.txtpage_id;
+END`,
+	"ALTER TABLE txtpage_revision ADD COLUMN editor TEXT NOT NULL DEFAULT ''",
+
+	// Private pages, readable only with a view password, and server
+	// secrets such as the view cookie signing key.
+	"ALTER TABLE txtpage ADD COLUMN view_password TEXT NOT NULL DEFAULT ''",
+	`CREATE TABLE secret (
+	name TEXT PRIMARY KEY NOT NULL,
+	value BLOB NOT NULL
+)`,
+
+	// Private pages with their title and content encrypted. Encrypted
+	// title and content are left out of the search index.
+	"ALTER TABLE txtpage ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0",
+	"DROP TRIGGER txtpage_fts_insert",
+	"DROP TRIGGER txtpage_fts_delete",
+	"DROP TRIGGER txtpage_fts_update",
+	`CREATE TRIGGER txtpage_fts_insert AFTER INSERT ON txtpage BEGIN
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, IIF(new.encrypted, '', new.title), new.desc, new.author, IIF(new.encrypted, '', new.content));
+END`,
+	`CREATE TRIGGER txtpage_fts_delete AFTER DELETE ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, IIF(old.encrypted, '', old.title), old.desc, old.author, IIF(old.encrypted, '', old.content));
+END`,
+	`CREATE TRIGGER txtpage_fts_update AFTER UPDATE OF title, desc, author, content, encrypted ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, IIF(old.encrypted, '', old.title), old.desc, old.author, IIF(old.encrypted, '', old.content));
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, IIF(new.encrypted, '', new.title), new.desc, new.author, IIF(new.encrypted, '', new.content));
+END`,
+
+	// Pastes encrypted in the browser. The server only has the ciphertext.
+	`CREATE TABLE paste (
+	paste_id INTEGER PRIMARY KEY NOT NULL,
+	url TEXT UNIQUE NOT NULL,
+	data TEXT NOT NULL DEFAULT '',
+	passcode TEXT NOT NULL DEFAULT '',
+	createdt TEXT NOT NULL,
+	lastreaddt TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1
+)`,
+
+	// Self-destructing pages, deleted once views_left reaches 0.
+	"ALTER TABLE txtpage ADD COLUMN max_views INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE txtpage ADD COLUMN views_left INTEGER NOT NULL DEFAULT 0",
+
+	// Per-page expiry policy. Pages with a timed policy expire at
+	// expiresdt, and pinned pages never expire.
+	"ALTER TABLE txtpage ADD COLUMN expiry TEXT NOT NULL DEFAULT 'inactive'",
+	"ALTER TABLE txtpage ADD COLUMN expiresdt TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE txtpage ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0",
+	"CREATE INDEX txtpage_expiresdt ON txtpage (expiresdt)",
+
+	// Leave desc and author of encrypted pages out of the search index
+	// too, reindexing the encrypted pages already indexed with them.
+	"INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) SELECT 'delete', txtpage_id, '', desc, author, '' FROM txtpage WHERE encrypted = 1",
+	"INSERT INTO txtpage_fts (rowid, title, desc, author, content) SELECT txtpage_id, '', '', '', '' FROM txtpage WHERE encrypted = 1",
+	"DROP TRIGGER txtpage_fts_insert",
+	"DROP TRIGGER txtpage_fts_delete",
+	"DROP TRIGGER txtpage_fts_update",
+	`CREATE TRIGGER txtpage_fts_insert AFTER INSERT ON txtpage BEGIN
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, IIF(new.encrypted, '', new.title), IIF(new.encrypted, '', new.desc), IIF(new.encrypted, '', new.author), IIF(new.encrypted, '', new.content));
+END`,
+	`CREATE TRIGGER txtpage_fts_delete AFTER DELETE ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, IIF(old.encrypted, '', old.title), IIF(old.encrypted, '', old.desc), IIF(old.encrypted, '', old.author), IIF(old.encrypted, '', old.content));
+END`,
+	`CREATE TRIGGER txtpage_fts_update AFTER UPDATE OF title, desc, author, content, encrypted ON txtpage BEGIN
+	INSERT INTO txtpage_fts (txtpage_fts, rowid, title, desc, author, content) VALUES ('delete', old.txtpage_id, IIF(old.encrypted, '', old.title), IIF(old.encrypted, '', old.desc), IIF(old.encrypted, '', old.author), IIF(old.encrypted, '', old.content));
+	INSERT INTO txtpage_fts (rowid, title, desc, author, content) VALUES (new.txtpage_id, IIF(new.encrypted, '', new.title), IIF(new.encrypted, '', new.desc), IIF(new.encrypted, '', new.author), IIF(new.encrypted, '', new.content));
+END`,
+}
+
 func (z Z) Error() string {
 	if z == Z_OK {
 		return "OK"
@@ -46,6 +286,14 @@ func (z Z) Error() string {
 		return "Not found"
 	} else if z == Z_WRONG_PASSCODE {
 		return "Incorrect passcode"
+	} else if z == Z_EDIT_CONFLICT {
+		return "Page was changed since you started editing"
+	} else if z == Z_OWNER_ONLY {
+		return "Only the page owner can do this"
+	} else if z == Z_CONTENT_ONLY {
+		return "Your passcode can only change the page content"
+	} else if z == Z_APPEND_ONLY {
+		return "Your passcode can only add to the end of the page content"
 	}
 	return "Unknown error"
 }
@@ -55,10 +303,11 @@ func create_tables(dbfile string) error {
 		return fmt.Errorf("File '%s' exists", dbfile)
 	}
 
-	db, err := sql.Open("sqlite3", dbfile)
+	db, err := open_db(dbfile)
 	if err != nil {
 		return err
 	}
+	defer db.close()
 
 	ss := []string{
 		`CREATE TABLE txtpage (
@@ -95,28 +344,56 @@ VALUES(
 );`,
 	}
 
-	tx, err := db.Begin()
+	err = db.write(func(tx *Tx) error {
+		for _, s := range ss {
+			// Schema statements are run directly instead of being cached.
+			_, err := tx.Exec(s)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	for _, s := range ss {
-		_, err := txexec(tx, s)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	err = tx.Commit()
+	return migrate_tables(db)
+}
+
+// Apply any migrations not yet applied to db.
+func migrate_tables(db *DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
 	if err != nil {
 		return err
 	}
-	return nil
+	if version >= len(migrations) {
+		return nil
+	}
+	return db.write(func(tx *Tx) error {
+		for i := version; i < len(migrations); i++ {
+			_, err := tx.Exec(migrations[i])
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)))
+		return err
+	})
+}
+
+type RowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func find_txtpage_by_id(db *sql.DB, id int64, tp *TxtPage) Z {
-	s := "SELECT txtpage_id, title, url, content, desc, author, passcode, createdt, lastreaddt FROM txtpage WHERE txtpage_id = ?"
-	row := db.QueryRow(s, id)
-	err := row.Scan(&tp.txtpage_id, &tp.title, &tp.url, &tp.content, &tp.desc, &tp.author, &tp.passcode, &tp.createdt, &tp.lastreaddt)
+func scan_txtpage(row RowScanner, tp *TxtPage) error {
+	return row.Scan(&tp.txtpage_id, &tp.title, &tp.url, &tp.content, &tp.desc, &tp.author, &tp.passcode, &tp.createdt, &tp.lastreaddt, &tp.views, &tp.searchable, &tp.listed, &tp.tags, &tp.toc, &tp.version, &tp.view_password, &tp.encrypted, &tp.max_views, &tp.views_left, &tp.expiry, &tp.expiresdt, &tp.pinned)
+}
+
+func find_txtpage_by_id(db *DB, id int64, tp *TxtPage) Z {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE txtpage_id = ?"
+	row := sqlqueryrow(db, s, id)
+	err := scan_txtpage(row, tp)
 	if err == sql.ErrNoRows {
 		return Z_NOT_FOUND
 	}
@@ -126,10 +403,10 @@ func find_txtpage_by_id(db *sql.DB, id int64, tp *TxtPage) Z {
 	}
 	return Z_OK
 }
-func find_txtpage_by_url(db *sql.DB, url string, tp *TxtPage) Z {
-	s := "SELECT txtpage_id, title, url, content, desc, author, passcode, createdt, lastreaddt FROM txtpage WHERE url = ?"
-	row := db.QueryRow(s, url)
-	err := row.Scan(&tp.txtpage_id, &tp.title, &tp.url, &tp.content, &tp.desc, &tp.author, &tp.passcode, &tp.createdt, &tp.lastreaddt)
+func find_txtpage_by_url(db *DB, url string, tp *TxtPage) Z {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE url = ?"
+	row := sqlqueryrow(db, s, url)
+	err := scan_txtpage(row, tp)
 	if err == sql.ErrNoRows {
 		return Z_NOT_FOUND
 	}
@@ -139,9 +416,9 @@ func find_txtpage_by_url(db *sql.DB, url string, tp *TxtPage) Z {
 	}
 	return Z_OK
 }
-func find_all_txtpage_orderby_createdt(db *sql.DB) (TxtPages, Z) {
-	s := "SELECT txtpage_id, title, url, content, desc, author, passcode, createdt, lastreaddt FROM txtpage ORDER BY createdt DESC"
-	rows, err := db.Query(s)
+func find_all_txtpage_orderby_createdt(db *DB) (TxtPages, Z) {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage ORDER BY createdt DESC"
+	rows, err := sqlquery(db, s)
 	if err != nil {
 		logerr("find_all_txtpage_orderby_createdt", err)
 		return nil, Z_DBERR
@@ -151,7 +428,7 @@ func find_all_txtpage_orderby_createdt(db *sql.DB) (TxtPages, Z) {
 	tt := TxtPages{}
 	for rows.Next() {
 		var tp TxtPage
-		err := rows.Scan(&tp.txtpage_id, &tp.title, &tp.url, &tp.content, &tp.desc, &tp.author, &tp.passcode, &tp.createdt, &tp.lastreaddt)
+		err := scan_txtpage(rows, &tp)
 		if err != nil {
 			logerr("find_all_txtpage_orderby_createdt", err)
 			return nil, Z_DBERR
@@ -182,7 +459,7 @@ func content_to_desc(content string) string {
 	return desc
 }
 
-func create_txtpage(db *sql.DB, tp *TxtPage) Z {
+func create_txtpage(db *DB, tp *TxtPage) Z {
 	if tp.url != "" {
 		tp.url = sanitize_txtpage_url(tp.url)
 	}
@@ -201,43 +478,82 @@ func create_txtpage(db *sql.DB, tp *TxtPage) Z {
 	if tp.passcode == "" {
 		tp.passcode = random_passcode()
 	}
-	tp.content = process_content(tp.content)
-
-	var s string
-	var result sql.Result
-	var err error
-
-	if tp.url == "" {
-		// Generate unique url if no url specified.
-		s = "INSERT INTO txtpage (title, content, desc, author, passcode, createdt, lastreaddt, url) VALUES (?, ?, ?, ?, ?, ?, ?, ? || (SELECT IFNULL(MAX(txtpage_id), 0)+1 FROM txtpage))"
-		result, err = sqlexec(db, s, tp.title, tp.content, tp.desc, tp.author, tp.passcode, tp.createdt, tp.lastreaddt, sanitize_txtpage_url(tp.title))
-	} else {
-		s = "INSERT INTO txtpage (title, content, desc, author, passcode, createdt, lastreaddt, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-		result, err = sqlexec(db, s, tp.title, tp.content, tp.desc, tp.author, tp.passcode, tp.createdt, tp.lastreaddt, tp.url)
+	if tp.expiry == "" {
+		tp.expiry = EXPIRE_INACTIVE
 	}
+	tp.expiresdt = policy_expiresdt(tp.expiry)
+	tp.content = process_content(tp.content)
+	tp.encrypted = tp.key != nil
+	title, desc, content, err := stored_txtpage_text(tp)
 	if err != nil {
 		logerr("create_txtpage", err)
 		return Z_DBERR
 	}
-	id, err := result.LastInsertId()
+
+	// The page, its first revision, tags and links are saved together, so
+	// a page is never left without its base revision. tp.url is set again
+	// inside, as the write is retried if the db is busy.
+	url := tp.url
+	err = db.write(func(tx *Tx) error {
+		var s string
+		var result sql.Result
+		var err error
+
+		if url == "" {
+			// Generate unique url if no url specified.
+			s = "INSERT INTO txtpage (title, content, desc, author, passcode, createdt, lastreaddt, searchable, listed, tags, toc, view_password, encrypted, max_views, views_left, expiry, expiresdt, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? || (SELECT IFNULL(MAX(txtpage_id), 0)+1 FROM txtpage))"
+			result, err = txexec(tx, s, title, content, desc, tp.author, tp.passcode, tp.createdt, tp.lastreaddt, tp.searchable, tp.listed, tp.tags, tp.toc, tp.view_password, tp.encrypted, tp.max_views, tp.max_views, tp.expiry, tp.expiresdt, url_title_segment(tp))
+		} else {
+			s = "INSERT INTO txtpage (title, content, desc, author, passcode, createdt, lastreaddt, searchable, listed, tags, toc, view_password, encrypted, max_views, views_left, expiry, expiresdt, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			result, err = txexec(tx, s, title, content, desc, tp.author, tp.passcode, tp.createdt, tp.lastreaddt, tp.searchable, tp.listed, tp.tags, tp.toc, tp.view_password, tp.encrypted, tp.max_views, tp.max_views, tp.expiry, tp.expiresdt, url)
+		}
+		if is_unique_err(err) {
+			// Another page took url since it was checked.
+			return Z_URL_EXISTS
+		}
+		if err != nil {
+			return err
+		}
+		tp.txtpage_id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		tp.version = 1
+
+		s = "INSERT INTO txtpage_revision (txtpage_id, version, content, createdt, editor) VALUES (?, ?, ?, ?, ?)"
+		_, err = txexec(tx, s, tp.txtpage_id, tp.version, content, tp.createdt, PAGE_PASSCODE_NAME)
+		if err != nil {
+			return err
+		}
+
+		// If url was autogen, retrieve the url of the page we just created.
+		tp.url = url
+		if tp.url == "" {
+			err = txqueryrow(tx, "SELECT url FROM txtpage WHERE txtpage_id = ?", tp.txtpage_id).Scan(&tp.url)
+			if err != nil {
+				return err
+			}
+		}
+		err = txsave_txtpage_tags(tx, tp)
+		if err != nil {
+			return err
+		}
+		return txsave_txtpage_links(tx, tp)
+	})
+	if err == Z_URL_EXISTS {
+		return Z_URL_EXISTS
+	}
 	if err != nil {
 		logerr("create_txtpage", err)
 		return Z_DBERR
 	}
-	tp.txtpage_id = id
-
-	// If url was autogen, load the page we just created to retrieve the url.
-	if tp.url == "" {
-		z := find_txtpage_by_id(db, id, tp)
-		if z != Z_OK {
-			return z
-		}
-	}
 	return Z_OK
 }
 
-func edit_txtpage(db *sql.DB, tp *TxtPage, passcode string) Z {
-	if passcode != tp.passcode {
+// Save tp, edited with passcode cred. Check the edit is allowed for the
+// passcode's role with check_edit() first.
+func edit_txtpage(db *DB, tp *TxtPage, cred *Credential) Z {
+	if cred == nil {
 		return Z_WRONG_PASSCODE
 	}
 	if tp.url != "" {
@@ -256,31 +572,182 @@ func edit_txtpage(db *sql.DB, tp *TxtPage, passcode string) Z {
 	if tp.passcode == "" {
 		tp.passcode = random_passcode()
 	}
+	tp.encrypted = tp.key != nil
 	if tp.url == "" {
 		tp.url = generate_url(tp)
 	}
+	if tp.expiry == "" {
+		tp.expiry = EXPIRE_INACTIVE
+	}
 	tp.content = process_content(tp.content)
+	title, desc, content, err := stored_txtpage_text(tp)
+	if err != nil {
+		logerr("edit_txtpage", err)
+		return Z_DBERR
+	}
 
-	s := "UPDATE txtpage SET title = ?, content = ?, desc = ?, author = ?, passcode = ?, lastreaddt = ?, url = ? WHERE txtpage_id = ?"
-	_, err := sqlexec(db, s, tp.title, tp.content, tp.desc, tp.author, tp.passcode, tp.lastreaddt, tp.url, tp.txtpage_id)
+	// Only save over the version tp was loaded from. If someone else saved
+	// the page in the meantime, return Z_EDIT_CONFLICT.
+	err = db.write(func(tx *Tx) error {
+		var oldurl, old_view_password string
+		err := txqueryrow(tx, "SELECT url, view_password FROM txtpage WHERE txtpage_id = ?", tp.txtpage_id).Scan(&oldurl, &old_view_password)
+		if err != nil {
+			return err
+		}
+
+		s := "UPDATE txtpage SET title = ?, content = ?, desc = ?, author = ?, passcode = ?, lastreaddt = ?, searchable = ?, listed = ?, tags = ?, toc = ?, view_password = ?, encrypted = ?, url = ?, version = version + 1, views_left = IIF(max_views = ?, views_left, ?), max_views = ?, expiresdt = IIF(expiry = ?, expiresdt, ?), expiry = ? WHERE txtpage_id = ? AND version = ?"
+		result, err := txexec(tx, s, title, content, desc, tp.author, tp.passcode, tp.lastreaddt, tp.searchable, tp.listed, tp.tags, tp.toc, tp.view_password, tp.encrypted, tp.url, tp.max_views, tp.max_views, tp.max_views, tp.expiry, policy_expiresdt(tp.expiry), tp.expiry, tp.txtpage_id, tp.version)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return Z_EDIT_CONFLICT
+		}
+
+		s = "INSERT OR REPLACE INTO txtpage_revision (txtpage_id, version, content, createdt, editor) VALUES (?, ?, ?, ?, ?)"
+		_, err = txexec(tx, s, tp.txtpage_id, tp.version+1, content, tp.lastreaddt, cred.name)
+		if err != nil {
+			return err
+		}
+		if tp.view_password != old_view_password {
+			return delete_page_history(tx, tp.txtpage_id, tp.version+1, oldurl)
+		}
+		_, err = txexec(tx, "DELETE FROM txtpage_revision WHERE txtpage_id = ? AND version <= ?", tp.txtpage_id, tp.version+1-MAX_REVISIONS)
+		return err
+	})
+	if err == Z_EDIT_CONFLICT {
+		return Z_EDIT_CONFLICT
+	}
 	if err != nil {
 		logerr("edit_txtpage", err)
 		return Z_DBERR
 	}
-	return Z_OK
+	tp.version++
+	z := save_txtpage_tags(db, tp)
+	if z != Z_OK {
+		return z
+	}
+	return save_txtpage_links(db, tp)
 }
 
-func touch_txtpage_by_url(db *sql.DB, url string) Z {
-	s := "UPDATE txtpage SET lastreaddt = ? WHERE url = ?"
-	_, err := sqlexec(db, s, nowdate(), url)
+// Return content of txtpage tp at version, decrypted with tp's key if the
+// page is encrypted. Only the last MAX_REVISIONS versions are kept.
+func find_txtpage_revision(db *DB, tp *TxtPage, version int64) (string, Z) {
+	s := "SELECT content FROM txtpage_revision WHERE txtpage_id = ? AND version = ?"
+	row := sqlqueryrow(db, s, tp.txtpage_id, version)
+	var content string
+	err := row.Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", Z_NOT_FOUND
+	}
 	if err != nil {
-		logerr("touch_txtpage_by_url", err)
+		logerr("find_txtpage_revision", err)
+		return "", Z_DBERR
+	}
+	if tp.encrypted {
+		content, err = decrypt_text(tp.key, content)
+		if err != nil {
+			// Encrypted with a view password since changed.
+			return "", Z_NOT_FOUND
+		}
+	}
+	return content, Z_OK
+}
+
+// Delete revisions of page other than version, and its pending drafts and
+// suggestions. Done when the view password changes, so nothing is kept
+// unencrypted or encrypted with the old password.
+func delete_page_history(tx *Tx, txtpage_id int64, version int64, url string) error {
+	_, err := txexec(tx, "DELETE FROM txtpage_revision WHERE txtpage_id = ? AND version <> ?", txtpage_id, version)
+	if err != nil {
+		return err
+	}
+	_, err = txexec(tx, "DELETE FROM draft WHERE page = ?", url)
+	if err != nil {
+		return err
+	}
+	_, err = txexec(tx, "DELETE FROM suggestion WHERE txtpage_id = ?", txtpage_id)
+	return err
+}
+
+// Save tp as repaired by editor, as a new version with its revision, tags
+// and links. Title and content are saved as is, so an encrypted tp is saved
+// still encrypted.
+func update_txtpage(db *DB, tp *TxtPage, editor string) Z {
+	err := db.write(func(tx *Tx) error {
+		s := "UPDATE txtpage SET title = ?, url = ?, content = ?, desc = ?, author = ?, passcode = ?, createdt = ?, lastreaddt = ?, searchable = ?, listed = ?, tags = ?, toc = ?, version = version + 1 WHERE txtpage_id = ? AND version = ?"
+		result, err := txexec(tx, s, tp.title, tp.url, tp.content, tp.desc, tp.author, tp.passcode, tp.createdt, tp.lastreaddt, tp.searchable, tp.listed, tp.tags, tp.toc, tp.txtpage_id, tp.version)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return Z_EDIT_CONFLICT
+		}
+		s = "INSERT OR REPLACE INTO txtpage_revision (txtpage_id, version, content, createdt, editor) VALUES (?, ?, ?, ?, ?)"
+		_, err = txexec(tx, s, tp.txtpage_id, tp.version+1, tp.content, nowdate(), editor)
+		if err != nil {
+			return err
+		}
+		_, err = txexec(tx, "DELETE FROM txtpage_revision WHERE txtpage_id = ? AND version <= ?", tp.txtpage_id, tp.version+1-MAX_REVISIONS)
+		return err
+	})
+	if err == Z_EDIT_CONFLICT {
+		return Z_EDIT_CONFLICT
+	}
+	if err != nil {
+		logerr("update_txtpage", err)
+		return Z_DBERR
+	}
+	tp.version++
+	z := save_txtpage_tags(db, tp)
+	if z != Z_OK {
+		return z
+	}
+	return save_txtpage_links(db, tp)
+}
+
+// Apply buffered page reads in a single transaction.
+func update_txtpage_reads(db *DB, reads map[int64]*PageReads) Z {
+	s := "UPDATE txtpage SET lastreaddt = MAX(lastreaddt, ?), views = views + ? WHERE txtpage_id = ?"
+	err := db.write(func(tx *Tx) error {
+		for id, pr := range reads {
+			_, err := txexec(tx, s, pr.lastreaddt, pr.views, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logerr("update_txtpage_reads", err)
 		return Z_DBERR
 	}
 	return Z_OK
 }
 
+// Sanitize each '/' separated segment of url. Empty segments are dropped so
+// nested urls never have leading, trailing or doubled slashes.
 func sanitize_txtpage_url(url string) string {
+	segs := []string{}
+	for _, seg := range strings.Split(url, "/") {
+		seg = sanitize_url_segment(seg)
+		if seg == "" {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func sanitize_url_segment(url string) string {
 	url = strings.TrimSpace(strings.ToLower(url))
 
 	// Replace whitespace with "_"
@@ -296,7 +763,16 @@ func sanitize_txtpage_url(url string) string {
 
 // Generate txtpage url: title + txtpage_id
 func generate_url(tp *TxtPage) string {
-	return fmt.Sprintf("%s%d", sanitize_txtpage_url(tp.title), tp.txtpage_id)
+	return fmt.Sprintf("%s%d", url_title_segment(tp), tp.txtpage_id)
+}
+
+// Title part of generated urls. Encrypted pages don't give away their title,
+// whether tp is unlocked or still holds the ciphertext.
+func url_title_segment(tp *TxtPage) string {
+	if tp.encrypted || tp.key != nil {
+		return "private"
+	}
+	return sanitize_url_segment(tp.title)
 }
 
 func process_content(content string) string {
@@ -309,9 +785,9 @@ func process_content(content string) string {
 
 // Return true if url exists in a previous txtpage row.
 // Exclude row containing exclude_txtpage_id in the check.
-func txtpage_url_exists(db *sql.DB, url string, exclude_txtpage_id int64) bool {
+func txtpage_url_exists(db *DB, url string, exclude_txtpage_id int64) bool {
 	s := "SELECT txtpage_id FROM txtpage WHERE url = ? AND txtpage_id <> ?"
-	row := db.QueryRow(s, url, exclude_txtpage_id)
+	row := sqlqueryrow(db, s, url, exclude_txtpage_id)
 	var tmpid int64
 	err := row.Scan(&tmpid)
 	if err == sql.ErrNoRows {
@@ -323,37 +799,42 @@ func txtpage_url_exists(db *sql.DB, url string, exclude_txtpage_id int64) bool {
 	return true
 }
 
-// Delete txtpages with lastreaddt before specified duration
+// Delete txtpages past their expiresdt, and txtpages with the inactive
+// expiry policy and lastreaddt before the inactive duration. Pinned
+// txtpages are kept.
 // Ex.
-// Delete with lastreaddt older than 60 seconds
-// delete_txtpages_before_duration(60 * time.Second)
+// Delete inactive txtpages with lastreaddt older than 60 days
+// delete_expired_txtpages(60 * time.Hour * 24)
 //
-// Delete with lastreaddt older than 60 days
-// delete_txtpages_before_duration(60 * time.Hour * 24)
-func delete_txtpages_before_duration(db *sql.DB, d time.Duration) Z {
+// Returns the urls of the deleted txtpages.
+func delete_expired_txtpages(db *DB, inactive time.Duration) ([]string, Z) {
 	var err error
-	cutoffdt := isodate(time.Now().Add(-d))
-	logprint("Deleting txtpages older than %s\n", cutoffdt)
+	nowdt := nowdate()
+	cutoffdt := isodate(time.Now().Add(-inactive))
+	logprint("Deleting txtpages expired by %s or inactive since %s\n", nowdt, cutoffdt)
 
-	s1 := "SELECT txtpage_id, title, lastreaddt FROM txtpage WHERE lastreaddt < ?"
-	rows, err := db.Query(s1, cutoffdt)
+	where := "pinned = 0 AND ((expiresdt <> '' AND expiresdt < ?) OR (expiry = ? AND lastreaddt < ?))"
+	s1 := "SELECT txtpage_id, title, url, lastreaddt FROM txtpage WHERE " + where
+	rows, err := sqlquery(db, s1, nowdt, EXPIRE_INACTIVE, cutoffdt)
 	if err != nil {
-		logerr("delete_txtpages_before_duration", err)
-		return Z_DBERR
+		logerr("delete_expired_txtpages", err)
+		return nil, Z_DBERR
 	}
 	defer rows.Close()
+	urls := []string{}
 	for rows.Next() {
 		var id int64
-		var title, lastreaddt string
-		rows.Scan(&id, &title, &lastreaddt)
-		logprint("***  %s %d %s\n", lastreaddt, id, title)
+		var title, url, lastreaddt string
+		rows.Scan(&id, &title, &url, &lastreaddt)
+		logprint("***  %s %d %s\n", lastreaddt, id, url)
+		urls = append(urls, url)
 	}
 
-	s := "DELETE FROM txtpage WHERE lastreaddt < ?"
-	_, err = sqlexec(db, s, cutoffdt)
+	s := "DELETE FROM txtpage WHERE " + where
+	_, err = sqlexec(db, s, nowdt, EXPIRE_INACTIVE, cutoffdt)
 	if err != nil {
-		logerr("delete_txtpages_before_duration", err)
-		return Z_DBERR
+		logerr("delete_expired_txtpages", err)
+		return nil, Z_DBERR
 	}
-	return Z_OK
+	return urls, Z_OK
 }
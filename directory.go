@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Directory listing sort orders
+const (
+	DIR_SORT_RECENT  = "recent"
+	DIR_SORT_POPULAR = "popular"
+)
+
+// Pages per directory page
+const DIRECTORY_LIMIT = 25
+
+// Return txtpages opted into public listing, sorted by sort.
+// Pass limit -1 to return all of them.
+func find_listed_txtpages(db *DB, sort string, limit int, offset int) (TxtPages, Z) {
+	orderby := "createdt DESC"
+	if sort == DIR_SORT_POPULAR {
+		orderby = "views DESC, createdt DESC"
+	}
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE listed = 1 AND view_password = '' AND max_views = 0 AND " + NOT_EXPIRED_SQL + " ORDER BY " + orderby + " LIMIT ? OFFSET ?"
+	rows, err := sqlquery(db, s, nowdate(), limit, offset)
+	if err != nil {
+		logerr("find_listed_txtpages", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	tt := TxtPages{}
+	for rows.Next() {
+		var tp TxtPage
+		err := scan_txtpage(rows, &tp)
+		if err != nil {
+			logerr("find_listed_txtpages", err)
+			return nil, Z_DBERR
+		}
+		tt = append(tt, &tp)
+	}
+	return tt, Z_OK
+}
+
+func (server *Server) directory_handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	sort := r.FormValue("sort")
+	if sort != DIR_SORT_POPULAR {
+		sort = DIR_SORT_RECENT
+	}
+	pagenum := atoi(r.FormValue("p"))
+	if pagenum < 1 {
+		pagenum = 1
+	}
+
+	// One extra page is queried to tell if there's a next page.
+	tt, z := find_listed_txtpages(server.db, sort, DIRECTORY_LIMIT+1, (pagenum-1)*DIRECTORY_LIMIT)
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "DB error"})
+		print_header(P)
+		P("<p>DB error</p>\n")
+		html_print_close(P)
+		return
+	}
+	more := false
+	if len(tt) > DIRECTORY_LIMIT {
+		tt = tt[:DIRECTORY_LIMIT]
+		more = true
+	}
+
+	m := HtmlMeta{
+		title:       "TxtPages Directory",
+		description: "Directory of public txtpages",
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, r.Host, &m)
+	print_header(P)
+	P("<h2>Directory</h2>\n")
+	P("<p><a href=\"/tag\">Browse by tag</a></p>\n")
+	if sort == DIR_SORT_POPULAR {
+		P("<p><a href=\"/directory\">Recent</a> | <strong>Popular</strong></p>\n")
+	} else {
+		P("<p><strong>Recent</strong> | <a href=\"/directory?sort=%s\">Popular</a></p>\n", DIR_SORT_POPULAR)
+	}
+
+	if len(tt) == 0 {
+		P("<p>No txtpages listed.</p>\n")
+	}
+	for _, tp := range tt {
+		print_directory_entry(P, tp)
+	}
+
+	P("<div class=\"titlebar\">\n")
+	if pagenum > 1 {
+		P("    <p><a href=\"/directory?sort=%s&amp;p=%d\">Previous</a></p>\n", sort, pagenum-1)
+	} else {
+		P("    <p></p>\n")
+	}
+	if more {
+		P("    <p><a href=\"/directory?sort=%s&amp;p=%d\">Next</a></p>\n", sort, pagenum+1)
+	}
+	P("</div>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+func print_directory_entry(P PrintFunc, tp *TxtPage) {
+	desc := tp.desc
+	if desc == "" {
+		desc = content_to_desc(tp.content)
+	}
+	P("<div class=\"directory_entry\">\n")
+	P("    <p><a href=\"/%s\">%s</a></p>\n", tp.url, escape(tp.title))
+	P("    <p class=\"directory_info\">%s", formatisodate(tp.createdt))
+	if tp.author != "" {
+		P(" by %s", escape(tp.author))
+	}
+	P("</p>\n")
+	P("    <p>%s</p>\n", escape(desc))
+	P("</div>\n")
+}
+
+// Sitemap of home page, stock pages and all publicly listed txtpages.
+func (server *Server) sitemap_handler(w http.ResponseWriter, r *http.Request) {
+	tt, z := find_listed_txtpages(server.db, DIR_SORT_RECENT, -1, 0)
+	if z != Z_OK {
+		http.Error(w, "Server database error.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	P := makePrintFunc(w)
+	P("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	P("<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n")
+	P("<url><loc>%s</loc></url>\n", escape(absolute_url(r.Host, "/")))
+	P("<url><loc>%s</loc></url>\n", escape(absolute_url(r.Host, "/directory")))
+	for _, sp := range stock_pages {
+		P("<url><loc>%s</loc></url>\n", escape(absolute_url(r.Host, "/"+sp.url)))
+	}
+	for _, tp := range tt {
+		lastmod := parseisodate(tp.createdt).Format("2006-01-02")
+		P("<url><loc>%s</loc><lastmod>%s</lastmod></url>\n", escape(absolute_url(r.Host, "/"+tp.url)), lastmod)
+	}
+	P("</urlset>\n")
+}
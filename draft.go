@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULT_DRAFT_DAYS = 7
+
+// Cookie holding the draft token of the browser.
+const DRAFT_COOKIE = "draft"
+
+// Largest draft form accepted by /draft.
+const MAX_DRAFT_BYTES = 1 << 20
+
+// Unsaved create or edit form contents. page is the url of the page being
+// edited, or "" for the new page form. The passcode is never stored.
+type Draft struct {
+	token      string
+	page       string
+	title      string
+	content    string
+	desc       string
+	author     string
+	url        string
+	tags       string
+	searchable bool
+	listed     bool
+	toc        bool
+	version    int64
+	updatedt   string
+}
+
+func find_draft(db *DB, token string, page string, after time.Time, d *Draft) Z {
+	s := "SELECT token, page, title, content, desc, author, url, tags, searchable, listed, toc, version, updatedt FROM draft WHERE token = ? AND page = ? AND updatedt >= ?"
+	row := sqlqueryrow(db, s, token, page, isodate(after))
+	err := row.Scan(&d.token, &d.page, &d.title, &d.content, &d.desc, &d.author, &d.url, &d.tags, &d.searchable, &d.listed, &d.toc, &d.version, &d.updatedt)
+	if err == sql.ErrNoRows {
+		return Z_NOT_FOUND
+	}
+	if err != nil {
+		logerr("find_draft", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func save_draft(db *DB, d *Draft) Z {
+	d.updatedt = nowdate()
+	s := "INSERT OR REPLACE INTO draft (token, page, title, content, desc, author, url, tags, searchable, listed, toc, version, updatedt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := sqlexec(db, s, d.token, d.page, d.title, d.content, d.desc, d.author, d.url, d.tags, d.searchable, d.listed, d.toc, d.version, d.updatedt)
+	if err != nil {
+		logerr("save_draft", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func delete_draft(db *DB, token string, page string) Z {
+	_, err := sqlexec(db, "DELETE FROM draft WHERE token = ? AND page = ?", token, page)
+	if err != nil {
+		logerr("delete_draft", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Delete drafts last saved more than d ago.
+func delete_old_drafts(db *DB, d time.Duration) Z {
+	_, err := sqlexec(db, "DELETE FROM draft WHERE updatedt < ?", isodate(time.Now().Add(-d)))
+	if err != nil {
+		logerr("delete_old_drafts", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return draft token from the request cookie, or "" if none.
+func draft_token(r *http.Request) string {
+	c, err := r.Cookie(DRAFT_COOKIE)
+	if err != nil || len(c.Value) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(c.Value); err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// Return the request draft token, creating one if needed. The cookie is
+// renewed so it lasts as long as the drafts it refers to.
+func (server *Server) set_draft_token(w http.ResponseWriter, r *http.Request) string {
+	token := draft_token(r)
+	if token == "" {
+		bs := make([]byte, 16)
+		rand.Read(bs)
+		token = hex.EncodeToString(bs)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     DRAFT_COOKIE,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(days_to_duration(server.cfg.draft_days).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+func (server *Server) draft_expiry() time.Time {
+	return time.Now().Add(-days_to_duration(server.cfg.draft_days))
+}
+
+// Fill in tp from the browser's draft for page, if there is one. Private
+// pages have no drafts, which would keep them unencrypted.
+func (server *Server) restore_draft(r *http.Request, page string, tp *TxtPage) *Draft {
+	token := draft_token(r)
+	if token == "" || tp.view_password != "" {
+		return nil
+	}
+	var d Draft
+	if find_draft(server.db, token, page, server.draft_expiry(), &d) != Z_OK {
+		return nil
+	}
+	tp.title = d.title
+	tp.content = d.content
+	tp.desc = d.desc
+	tp.author = d.author
+	tp.url = d.url
+	tp.tags = d.tags
+	tp.searchable = d.searchable
+	tp.listed = d.listed
+	tp.toc = d.toc
+	if page != "" {
+		tp.version = d.version
+	}
+	return &d
+}
+
+// Save form contents in tp as the browser's draft for page, unless tp is
+// private.
+func (server *Server) save_form_draft(w http.ResponseWriter, r *http.Request, page string, tp *TxtPage) {
+	if tp.view_password != "" {
+		return
+	}
+	d := Draft{
+		token:      server.set_draft_token(w, r),
+		page:       page,
+		title:      tp.title,
+		content:    tp.content,
+		desc:       tp.desc,
+		author:     tp.author,
+		url:        tp.url,
+		tags:       tp.tags,
+		searchable: tp.searchable,
+		listed:     tp.listed,
+		toc:        tp.toc,
+		version:    tp.version,
+	}
+	save_draft(server.db, &d)
+}
+
+// Clear the browser's draft for page after the page is saved.
+func (server *Server) clear_draft(r *http.Request, page string) {
+	token := draft_token(r)
+	if token != "" {
+		delete_draft(server.db, token, page)
+	}
+}
+
+// Form path of the draft for page.
+func draft_form_href(page string) string {
+	if page == "" {
+		return "/"
+	}
+	return action_href("edit", page)
+}
+
+// POST /draft saves the posted create or edit form as a draft, for
+// draft.js autosave. With discard set, the draft is deleted instead and the
+// browser is sent back to an empty form.
+func (server *Server) draft_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_DRAFT_BYTES)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Draft too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	page := sanitize_txtpage_url(r.FormValue("draft_page"))
+	if r.FormValue("discard_draft") != "" {
+		server.clear_draft(r, page)
+		http.Redirect(w, r, draft_form_href(page), http.StatusSeeOther)
+		return
+	}
+
+	tp := TxtPage{
+		title:      strings.TrimSpace(r.FormValue("title")),
+		content:    strings.TrimSpace(r.FormValue("content")),
+		desc:       strings.TrimSpace(r.FormValue("desc")),
+		author:     strings.TrimSpace(r.FormValue("author")),
+		url:        strings.TrimSpace(r.FormValue("url")),
+		tags:       strings.TrimSpace(r.FormValue("tags")),
+		searchable: r.FormValue("searchable") != "",
+		listed:     r.FormValue("listed") != "",
+		toc:        r.FormValue("toc") != "",
+		version:    int64(atoi(r.FormValue("version"))),
+	}
+	var saved TxtPage
+	if page != "" && find_txtpage_by_url(server.db, page, &saved) == Z_OK {
+		tp.view_password = saved.view_password
+	}
+	server.save_form_draft(w, r, page, &tp)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Draft page key and autosave script, inside the create or edit form of
+// tp. If d was restored, say so. Private pages have no drafts.
+func print_form_draft(P PrintFunc, tp *TxtPage, page string, d *Draft) {
+	if tp.view_password != "" {
+		return
+	}
+	P("    <input type=\"hidden\" name=\"draft_page\" value=\"%s\">\n", escape(page))
+	P("    <script src=\"/static/draft.js\" defer></script>\n")
+	if d == nil {
+		return
+	}
+	P("    <div class=\"draft_notice\">\n")
+	P("        <p>Restored your unsaved changes from %s. Use Discard changes below to start over.</p>\n", formatdate(d.updatedt))
+	P("    </div>\n")
+}
+
+// Button to discard restored draft d. Comes after the save button, so that
+// pressing enter in the form still saves.
+func print_form_draft_button(P PrintFunc, d *Draft) {
+	if d == nil {
+		return
+	}
+	P("        <button type=\"submit\" name=\"discard_draft\" value=\"1\" formaction=\"/draft\">Discard changes</button>\n")
+}
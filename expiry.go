@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Page expiry policies, picked when creating or editing a page. Timed
+// policies expire at the page's expiresdt. EXPIRE_INACTIVE pages expire
+// once they haven't been read for CLEAR_OLD_PAGES_DURATION. Pages pinned by
+// the admin never expire.
+const EXPIRE_HOUR = "1h"
+const EXPIRE_DAY = "1d"
+const EXPIRE_WEEK = "1w"
+const EXPIRE_INACTIVE = "inactive"
+
+// Delete pages with the inactive policy and lastreaddt older than 6 months.
+const CLEAR_OLD_PAGES_DURATION = 6 * 30 * 24 * time.Hour
+
+// SQL condition for txtpages that haven't expired, taking nowdate() as the
+// parameter. Expired pages are left out of lists before the purge deletes
+// them.
+const NOT_EXPIRED_SQL = "(pinned = 1 OR expiresdt = '' OR expiresdt >= ?)"
+
+type ExpiryOption struct {
+	policy string
+	label  string
+	d      time.Duration
+}
+
+var expiry_options = []ExpiryOption{
+	{EXPIRE_HOUR, "After 1 hour", time.Hour},
+	{EXPIRE_DAY, "After 1 day", 24 * time.Hour},
+	{EXPIRE_WEEK, "After 1 week", 7 * 24 * time.Hour},
+	{EXPIRE_INACTIVE, "After 6 months without views", 0},
+}
+
+// Return the expiry policy from the create or edit form.
+func form_expiry(r *http.Request) string {
+	policy := r.FormValue("expiry")
+	for _, opt := range expiry_options {
+		if opt.policy == policy {
+			return policy
+		}
+	}
+	return EXPIRE_INACTIVE
+}
+
+// Return expiresdt of a page given policy now, or "" if it only expires
+// when inactive.
+func policy_expiresdt(policy string) string {
+	for _, opt := range expiry_options {
+		if opt.policy == policy && opt.d > 0 {
+			return isodate(time.Now().Add(opt.d))
+		}
+	}
+	return ""
+}
+
+// Return true if tp is past its expiresdt but not deleted yet.
+func is_txtpage_expired(tp *TxtPage) bool {
+	return !tp.pinned && tp.expiresdt != "" && tp.expiresdt < nowdate()
+}
+
+// Leave out expired pages.
+func unexpired_txtpages(tt TxtPages) TxtPages {
+	pp := TxtPages{}
+	for _, tp := range tt {
+		if !is_txtpage_expired(tp) {
+			pp = append(pp, tp)
+		}
+	}
+	return pp
+}
+
+func set_txtpage_pinned(db *DB, url string, pinned bool) Z {
+	result, err := sqlexec(db, "UPDATE txtpage SET pinned = ? WHERE url = ?", pinned, url)
+	if err != nil {
+		logerr("set_txtpage_pinned", err)
+		return Z_DBERR
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return Z_NOT_FOUND
+	}
+	return Z_OK
+}
+
+// Pin or unpin the page at url, so it never expires.
+func run_pin_cmd(dbfile string, url string, pinned bool) int {
+	if !file_exists(dbfile) {
+		fmt.Printf("dbfile '%s' doesn't exist.\n", dbfile)
+		return 1
+	}
+	db, err := open_db(dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	defer db.close()
+
+	err = migrate_tables(db)
+	if err != nil {
+		fmt.Printf("Error migrating '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	z := set_txtpage_pinned(db, sanitize_txtpage_url(url), pinned)
+	if z != Z_OK {
+		fmt.Printf("Error pinning '%s' (%s)\n", url, z)
+		return 1
+	}
+	return 0
+}
+
+// Footer line saying when tp expires. Inactive pages count from now, as
+// tp is being read.
+func print_expiry_notice(P PrintFunc, tp *TxtPage) {
+	if tp.pinned {
+		return
+	}
+	P("<p class=\"expiry_notice\">\n")
+	if tp.expiresdt != "" {
+		P("    This page expires on %s.\n", parseisodate(tp.expiresdt).Format("2 Jan 2006 15:04 MST"))
+	} else {
+		P("    This page expires on %s unless it's read again before then.\n", time.Now().UTC().Add(CLEAR_OLD_PAGES_DURATION).Format("2 Jan 2006"))
+	}
+	P("</p>\n")
+}
+
+// Expiry option of the create or edit form.
+func print_form_expiry(P PrintFunc, tp *TxtPage) {
+	policy := tp.expiry
+	if policy == "" {
+		policy = EXPIRE_INACTIVE
+	}
+	P("    <div>\n")
+	if tp.pinned {
+		P("        <label for=\"expiry\">Expires <i>(pinned by the site admin, so it never expires)</i></label>\n")
+	} else if tp.expiresdt != "" {
+		P("        <label for=\"expiry\">Expires <i>(on %s, picking another option counts from now)</i></label>\n", parseisodate(tp.expiresdt).Format("2 Jan 2006 15:04 MST"))
+	} else {
+		P("        <label for=\"expiry\">Expires</label>\n")
+	}
+	P("        <select id=\"expiry\" name=\"expiry\">\n")
+	for _, opt := range expiry_options {
+		selected := ""
+		if opt.policy == policy {
+			selected = " selected"
+		}
+		P("            <option value=\"%s\"%s>%s</option>\n", opt.policy, selected, opt.label)
+	}
+	P("        </select>\n")
+	P("    </div>\n")
+}
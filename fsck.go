@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Problem found by fsck in a txtpage row, and how to repair it.
+type FsckIssue struct {
+	desc string
+	fix  func(tp *TxtPage)
+}
+
+const FSCK_UNTITLED = "Untitled"
+const FSCK_NO_CONTENT = "*(This page has no content.)*"
+
+// Check db file for sqlite and txtpage problems. With fix set, repair all
+// problems found, otherwise ask before repairing each one if interactive.
+// Returns number of problems left unrepaired.
+func fsck_db(db *DB, fix bool, interactive bool) (int, error) {
+	nissues := 0
+	nfixed := 0
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var result string
+		rows.Scan(&result)
+		if result != "ok" {
+			fmt.Printf("integrity_check: %s\n", result)
+			nissues++
+		}
+	}
+	rows.Close()
+	if nissues > 0 {
+		fmt.Printf("sqlite integrity check failed, restore from a backup.\n")
+		return nissues, nil
+	}
+
+	tt, z := find_all_txtpage_orderby_createdt(db)
+	if z != Z_OK {
+		return 0, z
+	}
+
+	// Oldest page keeps its url when urls collide.
+	urls := map[string]bool{}
+	in := bufio.NewReader(os.Stdin)
+	for i := len(tt) - 1; i >= 0; i-- {
+		tp := tt[i]
+
+		issues := fsck_txtpage(db, tp, urls)
+		changed := false
+		for _, issue := range issues {
+			nissues++
+			fmt.Printf("%s (txtpage_id %d): %s\n", tp.url, tp.txtpage_id, issue.desc)
+			if !fix && !(interactive && prompt_yes(in, "Fix?")) {
+				continue
+			}
+			issue.fix(tp)
+			changed = true
+			nfixed++
+		}
+		if changed {
+			z = update_txtpage(db, tp, "fsck")
+			if z != Z_OK {
+				return nissues - nfixed, z
+			}
+		}
+		urls[tp.url] = true
+	}
+
+	fmt.Printf("%d txtpages checked, %d problems found, %d fixed.\n", len(tt), nissues, nfixed)
+	if nfixed > 0 {
+		fmt.Printf("Rebuild any git mirror of the db with the gitmirror command to include the fixes.\n")
+	}
+	return nissues - nfixed, nil
+}
+
+// Return problems in tp. urls holds the urls taken by pages already checked.
+func fsck_txtpage(db *DB, tp *TxtPage, urls map[string]bool) []FsckIssue {
+	issues := []FsckIssue{}
+
+	is_taken := func(url string) bool {
+		return url == "" || urls[url] || !is_url_allowed(url) || match_stock_page(url, stock_pages) != nil || txtpage_url_exists(db, url, tp.txtpage_id)
+	}
+	fix_url := func(tp *TxtPage) {
+		tp.url = generate_url(tp)
+		for n := 2; is_taken(tp.url); n++ {
+			tp.url = fmt.Sprintf("%s-%d", generate_url(tp), n)
+		}
+	}
+	if tp.url == "" {
+		issues = append(issues, FsckIssue{"empty url", fix_url})
+	} else if tp.url != sanitize_txtpage_url(tp.url) {
+		issues = append(issues, FsckIssue{fmt.Sprintf("url is not sanitized (should be '%s')", sanitize_txtpage_url(tp.url)), func(tp *TxtPage) {
+			tp.url = sanitize_txtpage_url(tp.url)
+			if is_taken(tp.url) {
+				fix_url(tp)
+			}
+		}})
+	} else if urls[tp.url] {
+		issues = append(issues, FsckIssue{"duplicate url", fix_url})
+	} else if !is_url_allowed(tp.url) {
+		issues = append(issues, FsckIssue{"url is a reserved name", fix_url})
+	} else if match_stock_page(tp.url, stock_pages) != nil {
+		issues = append(issues, FsckIssue{"url collides with a stock page", fix_url})
+	}
+
+	_, err := time.Parse(ISO8601Fmt, tp.createdt)
+	if err != nil {
+		issues = append(issues, FsckIssue{fmt.Sprintf("invalid createdt '%s'", tp.createdt), func(tp *TxtPage) {
+			_, err := time.Parse(ISO8601Fmt, tp.lastreaddt)
+			if err == nil {
+				tp.createdt = tp.lastreaddt
+			} else {
+				tp.createdt = nowdate()
+			}
+		}})
+	}
+	_, err = time.Parse(ISO8601Fmt, tp.lastreaddt)
+	if err != nil {
+		issues = append(issues, FsckIssue{fmt.Sprintf("invalid lastreaddt '%s'", tp.lastreaddt), func(tp *TxtPage) {
+			tp.lastreaddt = nowdate()
+		}})
+	}
+
+	if strings.TrimSpace(tp.title) == "" {
+		issues = append(issues, FsckIssue{"empty title", func(tp *TxtPage) {
+			tp.title = FSCK_UNTITLED
+		}})
+	}
+	if strings.TrimSpace(tp.content) == "" {
+		issues = append(issues, FsckIssue{"empty content", func(tp *TxtPage) {
+			tp.content = FSCK_NO_CONTENT
+		}})
+	}
+	return issues
+}
+
+func prompt_yes(in *bufio.Reader, prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	s, _ := in.ReadString('\n')
+	s = strings.ToLower(strings.TrimSpace(s))
+	return s == "y" || s == "yes"
+}
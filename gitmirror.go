@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// GitMirror commits every txtpage change into a local git repository,
+// one markdown file per page. Commits are made by shelling out to the
+// git binary from a single worker goroutine so they are applied in order.
+type GitMirror struct {
+	dir  string
+	ch   chan GitMirrorOp
+	done chan struct{}
+}
+
+type GitMirrorOp struct {
+	action string
+	tp     TxtPage
+	oldurl string
+}
+
+const GITMIRROR_QUEUE_LEN = 100
+const GITMIRROR_AUTHOR = "txtpages"
+const GITMIRROR_EMAIL = "txtpages@localhost"
+
+func open_gitmirror(dir string) (*GitMirror, error) {
+	err := gitmirror_init(dir)
+	if err != nil {
+		return nil, err
+	}
+	gm := &GitMirror{
+		dir:  dir,
+		ch:   make(chan GitMirrorOp, GITMIRROR_QUEUE_LEN),
+		done: make(chan struct{}),
+	}
+	go gm.run()
+	return gm, nil
+}
+
+// Create git repo in dir if it isn't one already.
+func gitmirror_init(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	if file_exists(filepath.Join(dir, ".git")) {
+		return nil
+	}
+	_, err = run_git(dir, nil, "init", "-q")
+	return err
+}
+
+func (gm *GitMirror) run() {
+	for op := range gm.ch {
+		err := gm.apply(&op)
+		if err != nil {
+			logerr("gitmirror", err)
+		}
+	}
+	close(gm.done)
+}
+
+// Wait for queued commits to finish. Safe to call on a nil GitMirror.
+func (gm *GitMirror) close() {
+	if gm == nil {
+		return
+	}
+	close(gm.ch)
+	<-gm.done
+}
+
+// Queue page change to be committed. Safe to call on a nil GitMirror.
+// Never blocks: if git has fallen behind and the queue is full, the change
+// is dropped and logged, and the mirror can be caught up with the
+// gitmirror command.
+func (gm *GitMirror) commit_page(action string, tp *TxtPage, oldurl string) {
+	if gm == nil {
+		return
+	}
+	select {
+	case gm.ch <- GitMirrorOp{action: action, tp: *tp, oldurl: oldurl}:
+	default:
+		logprint("gitmirror: queue full, dropped %s of %s. Rebuild the mirror with the gitmirror command.\n", action, tp.url)
+	}
+}
+
+func (gm *GitMirror) apply(op *GitMirrorOp) error {
+	var err error
+	url := op.tp.url
+
+	// Private and self-destructing pages are removed from the mirror
+	// rather than written out, whether or not they're encrypted yet.
+	if op.action == "delete" || !is_public_txtpage(&op.tp) {
+		err = os.Remove(gitmirror_page_file(gm.dir, url))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if op.oldurl != "" && op.oldurl != url {
+			err = os.Remove(gitmirror_page_file(gm.dir, op.oldurl))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	} else {
+		if op.oldurl != "" && op.oldurl != url {
+			err = os.Remove(gitmirror_page_file(gm.dir, op.oldurl))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = gitmirror_write_page(gm.dir, &op.tp)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg := fmt.Sprintf("%s /%s", op.action, url)
+	if op.oldurl != "" && op.oldurl != url {
+		msg = fmt.Sprintf("%s (renamed from /%s)", msg, op.oldurl)
+	}
+	return gitmirror_commit(gm.dir, msg, op.tp.author)
+}
+
+func gitmirror_page_file(dir string, url string) string {
+	return filepath.Join(dir, url+".md")
+}
+
+func gitmirror_write_page(dir string, tp *TxtPage) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Title: %s\n", tp.title)
+	if tp.author != "" {
+		fmt.Fprintf(&b, "Author: %s\n", tp.author)
+	}
+	if tp.desc != "" {
+		// Keep desc on a single line.
+		fmt.Fprintf(&b, "Description: %s\n", strings.Join(strings.Fields(tp.desc), " "))
+	}
+	fmt.Fprintf(&b, "Created: %s\n", tp.createdt)
+	fmt.Fprintf(&b, "\n%s\n", tp.content)
+
+	// Nested page urls are written into subdirectories.
+	file := gitmirror_page_file(dir, tp.url)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b.Bytes(), 0644)
+}
+
+// Return author as a name git accepts: without <, > or control chars, and
+// without the punctuation git strips from the ends. Falls back to
+// GITMIRROR_AUTHOR if nothing is left.
+func gitmirror_author_name(author string) string {
+	author = strings.Map(func(r rune) rune {
+		if r == '<' || r == '>' || unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, author)
+	author = strings.Trim(strings.Join(strings.Fields(author), " "), ".,:;'\"\\ ")
+	if author == "" {
+		return GITMIRROR_AUTHOR
+	}
+	return author
+}
+
+// Stage all changes and commit them. Does nothing if there are no changes.
+func gitmirror_commit(dir string, msg string, author string) error {
+	_, err := run_git(dir, nil, "add", "-A")
+	if err != nil {
+		return err
+	}
+	out, err := run_git(dir, nil, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+
+	env := []string{
+		"GIT_AUTHOR_NAME=" + gitmirror_author_name(author),
+		"GIT_AUTHOR_EMAIL=" + GITMIRROR_EMAIL,
+		"GIT_COMMITTER_NAME=" + GITMIRROR_AUTHOR,
+		"GIT_COMMITTER_EMAIL=" + GITMIRROR_EMAIL,
+	}
+	_, err = run_git(dir, env, "commit", "-q", "-m", msg)
+	return err
+}
+
+func run_git(dir string, env []string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %s (%s)", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// Rebuild git mirror working tree from all pages in db and commit the result.
+func rebuild_gitmirror(db *DB, dir string) error {
+	err := gitmirror_init(dir)
+	if err != nil {
+		return err
+	}
+
+	tt, z := find_all_txtpage_orderby_createdt(db)
+	if z != Z_OK {
+		return z
+	}
+
+	// Remove existing page files, then write out every page from the db.
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".md") {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, tp := range tt {
+		if !is_public_txtpage(tp) {
+			continue
+		}
+		err = gitmirror_write_page(dir, tp)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	return gitmirror_commit(dir, fmt.Sprintf("rebuild from database (%d pages)", n), "")
+}
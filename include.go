@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Limits on nested and total includes when rendering a page.
+const MAX_INCLUDE_DEPTH = 5
+const MAX_INCLUDES = 50
+
+// Cached pages before the render cache is cleared.
+const RENDER_CACHE_SIZE = 1000
+
+// {{include: url}} or {{include: url#heading-id}} on a line of its own.
+var include_re = regexp.MustCompile(`^\s*\{\{\s*include:\s*([^\s#{}]+)(?:#([^\s{}]+))?\s*\}\}\s*$`)
+
+// Includer expands include directives in page content, recording the urls
+// of every page looked up so the render can be invalidated when they change,
+// and where included text was placed in the expanded content.
+type Includer struct {
+	db       *DB
+	stack    []string
+	count    int
+	deps     map[string]bool
+	included [][2]int
+
+	// Earliest expiresdt of the included pages, or "" if none expire at a
+	// set time.
+	expiresdt string
+}
+
+// Return content with include directives replaced by the included markdown.
+// Directives inside fenced code blocks are left as is.
+func (inc *Includer) expand(content string) string {
+	var b strings.Builder
+	fence := ""
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")) {
+			fence = trimmed[:3]
+		} else if fence != "" && strings.HasPrefix(trimmed, fence) {
+			fence = ""
+		}
+		ss := include_re.FindStringSubmatch(line)
+		if fence != "" || ss == nil {
+			b.WriteString(line)
+			continue
+		}
+		b.WriteString("\n")
+		start := b.Len()
+		b.WriteString(inc.include(sanitize_txtpage_url(ss[1]), ss[2]))
+		if len(inc.stack) == 1 {
+			inc.included = append(inc.included, [2]int{start, b.Len()})
+		}
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// Return markdown of page url, or of its section under heading id if set.
+func (inc *Includer) include(url string, id string) string {
+	inc.deps[url] = true
+	if ss_contains(inc.stack, url) {
+		return fmt.Sprintf("*(Include cycle: %s)*", url)
+	}
+	if len(inc.stack) > MAX_INCLUDE_DEPTH {
+		return fmt.Sprintf("*(Includes nested too deep: %s)*", url)
+	}
+	if inc.count >= MAX_INCLUDES {
+		return fmt.Sprintf("*(Too many includes: %s)*", url)
+	}
+	inc.count++
+
+	var tp TxtPage
+	z := find_txtpage_by_url(inc.db, url, &tp)
+	if z != Z_OK || is_txtpage_expired(&tp) {
+		return fmt.Sprintf("*(Include not found: %s)*", url)
+	}
+	if tp.view_password != "" {
+		return fmt.Sprintf("*(Can't include private page: %s)*", url)
+	}
+	if tp.max_views > 0 {
+		return fmt.Sprintf("*(Can't include self-destructing page: %s)*", url)
+	}
+	if !tp.pinned && tp.expiresdt != "" && (inc.expiresdt == "" || tp.expiresdt < inc.expiresdt) {
+		inc.expiresdt = tp.expiresdt
+	}
+	content := tp.content
+	if id != "" {
+		section, ok := md_section(nil, []byte(content), id)
+		if !ok {
+			return fmt.Sprintf("*(Include section not found: %s#%s)*", url, id)
+		}
+		content = section
+	}
+
+	inc.stack = append(inc.stack, url)
+	content = inc.expand(content)
+	inc.stack = inc.stack[:len(inc.stack)-1]
+	return content
+}
+
+// RenderCache holds rendered page html along with the urls each render
+// depends on: the page itself, included pages and wiki link targets.
+type RenderCache struct {
+	mu      sync.Mutex
+	gen     int64
+	entries map[int64]*RenderEntry
+}
+
+// A render isn't used after expiresdt, when one of its included pages
+// expires.
+type RenderEntry struct {
+	html      string
+	deps      map[string]bool
+	expiresdt string
+}
+
+func create_render_cache() *RenderCache {
+	return &RenderCache{entries: map[int64]*RenderEntry{}}
+}
+
+func (rc *RenderCache) get(txtpage_id int64) (string, int64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[txtpage_id]
+	if !ok || (e.expiresdt != "" && e.expiresdt < nowdate()) {
+		return "", rc.gen, false
+	}
+	return e.html, rc.gen, true
+}
+
+// Cache render made at generation gen. Skipped if anything was invalidated
+// since, as the render may be stale.
+func (rc *RenderCache) put(txtpage_id int64, gen int64, e *RenderEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if gen != rc.gen {
+		return
+	}
+	if len(rc.entries) >= RENDER_CACHE_SIZE {
+		rc.entries = map[int64]*RenderEntry{}
+	}
+	rc.entries[txtpage_id] = e
+}
+
+// Drop renders depending on any of urls.
+func (rc *RenderCache) invalidate(urls ...string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.gen++
+	for id, e := range rc.entries {
+		for _, url := range urls {
+			if e.deps[url] {
+				delete(rc.entries, id)
+				break
+			}
+		}
+	}
+}
+
+// Return html of tp with includes expanded and wiki links resolved.
+func (server *Server) render_txtpage(tp *TxtPage) (string, error) {
+	html, gen, ok := server.cache.get(tp.txtpage_id)
+	if ok {
+		return html, nil
+	}
+	e, err := server.render_markdown(tp, true)
+	if err != nil {
+		return "", err
+	}
+	server.cache.put(tp.txtpage_id, gen, e)
+	return e.html, nil
+}
+
+// Render tp content the same as render_txtpage() but without section edit
+// links or caching, for previews of unsaved content.
+func (server *Server) render_preview(tp *TxtPage) (string, error) {
+	p := *tp
+	p.content = process_content(p.content)
+	e, err := server.render_markdown(&p, false)
+	if err != nil {
+		return "", err
+	}
+	return e.html, nil
+}
+
+// Render tp content to html, along with the urls of pages the html depends
+// on and when it expires.
+func (server *Server) render_markdown(tp *TxtPage, section_links bool) (*RenderEntry, error) {
+	content := tp.content
+	if tp.toc && !strings.Contains(content, TOC_MARKER) {
+		content = TOC_MARKER + "\n\n" + content
+	}
+	deps := map[string]bool{tp.url: true}
+	inc := Includer{db: server.db, stack: []string{tp.url}, deps: deps}
+	content = inc.expand(content)
+
+	opts := MdOptions{
+		resolve: func(target string) (string, bool) {
+			url, exists := server.resolve_wikilink(target)
+			deps[url] = true
+			return url, exists
+		},
+		included: inc.included,
+	}
+	if section_links {
+		opts.section_href = func(i int) string {
+			return fmt.Sprintf("%s?section=%d", action_href("edit", tp.url), i)
+		}
+	}
+	html, err := md_to_html(create_goldmark_interface(&opts), []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	return &RenderEntry{html: html, deps: deps, expiresdt: inc.expiresdt}, nil
+}
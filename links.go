@@ -0,0 +1,92 @@
+package main
+
+// Return urls of pages linked from tp with [[wiki links]].
+func txtpage_links(tp *TxtPage) []string {
+	urls := []string{}
+	for _, target := range md_wikilinks(nil, []byte(tp.content)) {
+		url := sanitize_txtpage_url(target)
+		if url == "" || url == tp.url || ss_contains(urls, url) {
+			continue
+		}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// Replace links of tp within tx.
+func txsave_txtpage_links(tx *Tx, tp *TxtPage) error {
+	urls := txtpage_links(tp)
+	if tp.encrypted {
+		// Links would give away encrypted content.
+		urls = nil
+	}
+	_, err := txexec(tx, "DELETE FROM txtpage_link WHERE txtpage_id = ?", tp.txtpage_id)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		_, err = txexec(tx, "INSERT INTO txtpage_link (txtpage_id, target_url) VALUES (?, ?)", tp.txtpage_id, url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func save_txtpage_links(db *DB, tp *TxtPage) Z {
+	err := db.write(func(tx *Tx) error {
+		return txsave_txtpage_links(tx, tp)
+	})
+	if err != nil {
+		logerr("save_txtpage_links", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return public pages linking to url, by title. Errors are logged and return
+// nil so a page still shows without its backlinks.
+func find_backlinks(db *DB, url string) TxtPages {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE view_password = '' AND max_views = 0 AND " + NOT_EXPIRED_SQL + " AND txtpage_id IN (SELECT txtpage_id FROM txtpage_link WHERE target_url = ?) ORDER BY title"
+	rows, err := sqlquery(db, s, nowdate(), url)
+	if err != nil {
+		logerr("find_backlinks", err)
+		return nil
+	}
+	defer rows.Close()
+
+	tt := TxtPages{}
+	for rows.Next() {
+		var tp TxtPage
+		err := scan_txtpage(rows, &tp)
+		if err != nil {
+			logerr("find_backlinks", err)
+			return nil
+		}
+		tt = append(tt, &tp)
+	}
+	return tt
+}
+
+// Resolve wiki link target to a txtpage or stock page url.
+func (server *Server) resolve_wikilink(target string) (string, bool) {
+	url := sanitize_txtpage_url(target)
+	if match_stock_page(url, stock_pages) != nil {
+		return url, true
+	}
+	return url, txtpage_url_exists(server.db, url, 0)
+}
+
+func print_backlinks(P PrintFunc, tt TxtPages) {
+	if len(tt) == 0 {
+		return
+	}
+	P("<nav class=\"backlinks\">\n")
+	P("<h2>Linked from</h2>\n")
+	P("<ul>\n")
+	for _, tp := range tt {
+		P("<li><a href=\"/%s\">%s</a></li>\n", tp.url, escape(tp.title))
+	}
+	P("</ul>\n")
+	P("</nav>\n")
+}
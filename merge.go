@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+)
+
+// Lines compared with full LCS before a changed region is treated as
+// entirely different, to bound time and memory on large inputs.
+const MAX_DIFF_CELLS = 4000000
+
+// Conflict markers written by merge3().
+const MERGE_MARK_MINE = "<<<<<<< your changes"
+const MERGE_MARK_SEP = "======="
+const MERGE_MARK_THEIRS = ">>>>>>> their changes"
+
+// Return for each line of a, the index of the matching line in b of a
+// longest common subsequence, or -1 if the line isn't matched.
+func lcs_match(a []string, b []string) []int {
+	m := make([]int, len(a))
+	for i := range m {
+		m[i] = -1
+	}
+
+	// Common prefix and suffix are matched directly.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		m[pre] = pre
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		m[len(a)-1-suf] = len(b) - 1 - suf
+		suf++
+	}
+	aa := a[pre : len(a)-suf]
+	bb := b[pre : len(b)-suf]
+	if len(aa) == 0 || len(bb) == 0 || len(aa)*len(bb) > MAX_DIFF_CELLS {
+		return m
+	}
+
+	// dp[i][j] is the LCS length of aa[i:] and bb[j:].
+	dp := make([][]int32, len(aa)+1)
+	for i := range dp {
+		dp[i] = make([]int32, len(bb)+1)
+	}
+	for i := len(aa) - 1; i >= 0; i-- {
+		for j := len(bb) - 1; j >= 0; j-- {
+			if aa[i] == bb[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else if dp[i+1][j] >= dp[i][j+1] {
+				dp[i][j] = dp[i+1][j]
+			} else {
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(aa) && j < len(bb); {
+		if aa[i] == bb[j] {
+			m[pre+i] = pre + j
+			i++
+			j++
+		} else if dp[i+1][j] >= dp[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return m
+}
+
+func lines_equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Three-way merge of mine and theirs, both changed from base. Returns the
+// merged text and false if there were conflicting changes, which are
+// included in the result between conflict markers.
+func merge3(base string, mine string, theirs string) (string, bool) {
+	bl := strings.Split(base, "\n")
+	ml := strings.Split(mine, "\n")
+	tl := strings.Split(theirs, "\n")
+	mm := lcs_match(bl, ml)
+	mt := lcs_match(bl, tl)
+
+	out := []string{}
+	clean := true
+	i, j, k := 0, 0, 0
+	for i < len(bl) || j < len(ml) || k < len(tl) {
+		// Base line unchanged in both.
+		if i < len(bl) && mm[i] == j && mt[i] == k {
+			out = append(out, bl[i])
+			i++
+			j++
+			k++
+			continue
+		}
+
+		// Changed region runs up to the next base line unchanged in both.
+		ni, nj, nk := i, len(ml), len(tl)
+		for ; ni < len(bl); ni++ {
+			if mm[ni] >= 0 && mt[ni] >= 0 {
+				nj, nk = mm[ni], mt[ni]
+				break
+			}
+		}
+		b, m, t := bl[i:ni], ml[j:nj], tl[k:nk]
+		if lines_equal(m, b) {
+			out = append(out, t...)
+		} else if lines_equal(t, b) || lines_equal(m, t) {
+			out = append(out, m...)
+		} else {
+			clean = false
+			out = append(out, MERGE_MARK_MINE)
+			out = append(out, m...)
+			out = append(out, MERGE_MARK_SEP)
+			out = append(out, t...)
+			out = append(out, MERGE_MARK_THEIRS)
+		}
+		i, j, k = ni, nj, nk
+	}
+	return strings.Join(out, "\n"), clean
+}
+
+// Line of a diff. op is ' ' for a line in both texts, '-' for a line only
+// in the old text and '+' for a line only in the new text.
+type DiffLine struct {
+	op   byte
+	text string
+}
+
+// Line diff from a to b.
+func line_diff(a string, b string) []DiffLine {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+	m := lcs_match(al, bl)
+
+	out := []DiffLine{}
+	j := 0
+	for i := range al {
+		if m[i] < 0 {
+			out = append(out, DiffLine{'-', al[i]})
+			continue
+		}
+		for ; j < m[i]; j++ {
+			out = append(out, DiffLine{'+', bl[j]})
+		}
+		out = append(out, DiffLine{' ', al[i]})
+		j++
+	}
+	for ; j < len(bl); j++ {
+		out = append(out, DiffLine{'+', bl[j]})
+	}
+	return out
+}
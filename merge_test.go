@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func lines(ss ...string) string {
+	return strings.Join(ss, "\n")
+}
+
+func conflict(mine []string, theirs []string) []string {
+	out := []string{MERGE_MARK_MINE}
+	out = append(out, mine...)
+	out = append(out, MERGE_MARK_SEP)
+	out = append(out, theirs...)
+	return append(out, MERGE_MARK_THEIRS)
+}
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		mine   string
+		theirs string
+		want   string
+		clean  bool
+	}{
+		{"unchanged", lines("a", "b", "c"), lines("a", "b", "c"), lines("a", "b", "c"), lines("a", "b", "c"), true},
+		{"only mine", lines("a", "b", "c"), lines("a", "B", "c"), lines("a", "b", "c"), lines("a", "B", "c"), true},
+		{"only theirs", lines("a", "b", "c"), lines("a", "b", "c"), lines("a", "b", "C"), lines("a", "b", "C"), true},
+		{"separate lines", lines("a", "b", "c", "d", "e"), lines("A", "b", "c", "d", "e"), lines("a", "b", "c", "d", "E"), lines("A", "b", "c", "d", "E"), true},
+		{"same change", lines("a", "b", "c"), lines("a", "X", "c"), lines("a", "X", "c"), lines("a", "X", "c"), true},
+		{"insert and delete", lines("a", "b", "c", "d"), lines("a", "new", "b", "c", "d"), lines("a", "b", "c"), lines("a", "new", "b", "c"), true},
+		{"both append", lines("a"), lines("a", "mine"), lines("a", "theirs"), lines(append([]string{"a"}, conflict([]string{"mine"}, []string{"theirs"})...)...), false},
+		{"overlapping", lines("a", "b", "c"), lines("a", "mine", "c"), lines("a", "theirs", "c"), lines(append(append([]string{"a"}, conflict([]string{"mine"}, []string{"theirs"})...), "c")...), false},
+		{"mine deletes theirs edits", lines("a", "b", "c"), lines("a", "c"), lines("a", "B", "c"), lines(append(append([]string{"a"}, conflict(nil, []string{"B"})...), "c")...), false},
+		{"empty base", "", lines("a", "b"), lines("a", "c"), lines(conflict([]string{"a", "b"}, []string{"a", "c"})...), false},
+		{"empty base same text", "", lines("a", "b"), lines("a", "b"), lines("a", "b"), true},
+	}
+	for _, tt := range tests {
+		got, clean := merge3(tt.base, tt.mine, tt.theirs)
+		if got != tt.want || clean != tt.clean {
+			t.Errorf("%s: merge3() = %q, %v, want %q, %v", tt.name, got, clean, tt.want, tt.clean)
+		}
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"same", lines("a", "b"), lines("a", "b"), lines(" a", " b")},
+		{"changed line", lines("a", "b", "c"), lines("a", "B", "c"), lines(" a", "-b", "+B", " c")},
+		{"added lines", lines("a"), lines("x", "a", "y"), lines("+x", " a", "+y")},
+		{"removed lines", lines("x", "a", "y"), lines("a"), lines("-x", " a", "-y")},
+		{"from empty", "", lines("a"), lines("-", "+a")},
+	}
+	for _, tt := range tests {
+		out := []string{}
+		for _, d := range line_diff(tt.a, tt.b) {
+			out = append(out, string(d.op)+d.text)
+		}
+		if got := lines(out...); got != tt.want {
+			t.Errorf("%s: line_diff() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Edits at both ends of a long text with many repeated lines merge cleanly.
+func TestMerge3Long(t *testing.T) {
+	base := make([]string, 3000)
+	for i := range base {
+		base[i] = strings.Repeat("x", i%7)
+	}
+	mine := append([]string{"first"}, base[1:]...)
+	theirs := append(append([]string{}, base[:len(base)-1]...), "last")
+	want := append(append([]string{"first"}, base[1:len(base)-1]...), "last")
+	got, clean := merge3(lines(base...), lines(mine...), lines(theirs...))
+	if got != lines(want...) || !clean {
+		t.Errorf("merge3() of long texts didn't merge cleanly")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+)
+
+// ReadBuffer collects page reads in memory so that viewing a page doesn't
+// cost a db write. Buffered reads are written out in one batch by flush(),
+// which runs on an interval and on shutdown.
+type ReadBuffer struct {
+	mu    sync.Mutex
+	reads map[int64]*PageReads
+}
+
+// Reads of one txtpage since the last flush.
+type PageReads struct {
+	lastreaddt string
+	views      int64
+}
+
+func create_read_buffer() *ReadBuffer {
+	return &ReadBuffer{reads: map[int64]*PageReads{}}
+}
+
+func (rb *ReadBuffer) touch(txtpage_id int64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	pr, ok := rb.reads[txtpage_id]
+	if !ok {
+		pr = &PageReads{}
+		rb.reads[txtpage_id] = pr
+	}
+	pr.lastreaddt = nowdate()
+	pr.views++
+}
+
+func (rb *ReadBuffer) flush(db *DB) Z {
+	rb.mu.Lock()
+	reads := rb.reads
+	rb.reads = map[int64]*PageReads{}
+	rb.mu.Unlock()
+
+	if len(reads) == 0 {
+		return Z_OK
+	}
+	z := update_txtpage_reads(db, reads)
+	if z != Z_OK {
+		// Put the reads back to be retried on the next flush.
+		rb.mu.Lock()
+		for id, pr := range reads {
+			cur, ok := rb.reads[id]
+			if !ok {
+				rb.reads[id] = pr
+				continue
+			}
+			cur.views += pr.views
+			if pr.lastreaddt > cur.lastreaddt {
+				cur.lastreaddt = pr.lastreaddt
+			}
+		}
+		rb.mu.Unlock()
+	}
+	return z
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix of page action paths: /-/<action>/<url>
+const ACTION_PREFIX = "-"
+
+// Ancestor of a nested page. exists is false if there's no page at url.
+type PageCrumb struct {
+	url    string
+	title  string
+	exists bool
+}
+
+// Position of a txtpage in the url hierarchy.
+type PageTree struct {
+	ancestors []PageCrumb
+	children  TxtPages
+}
+
+func action_href(action string, url string) string {
+	return fmt.Sprintf("/%s/%s/%s", ACTION_PREFIX, action, url)
+}
+
+// Split "-/<action>/<url>" into action and url.
+// Returns empty action if path is not an action path.
+func parse_action_path(path string) (string, string) {
+	ss := strings.SplitN(path, "/", 3)
+	if len(ss) < 2 || ss[0] != ACTION_PREFIX {
+		return "", ""
+	}
+	if len(ss) < 3 {
+		return ss[1], ""
+	}
+	return ss[1], ss[2]
+}
+
+// Return url of parent page, or "" for top level pages.
+func parent_url(url string) string {
+	i := strings.LastIndex(url, "/")
+	if i < 0 {
+		return ""
+	}
+	return url[:i]
+}
+
+// Return all pages nested under url, ordered by url. Only the url, title
+// and the fields needed to check visibility are read.
+func find_descendant_txtpages(db *DB, url string) (TxtPages, Z) {
+	// '0' is the char after '/' so this matches every url starting with url+"/".
+	s := "SELECT url, title, view_password, max_views, expiresdt, pinned FROM txtpage WHERE url > ? AND url < ? ORDER BY url"
+	rows, err := sqlquery(db, s, url+"/", url+"0")
+	if err != nil {
+		logerr("find_descendant_txtpages", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	tt := TxtPages{}
+	for rows.Next() {
+		var tp TxtPage
+		err := rows.Scan(&tp.url, &tp.title, &tp.view_password, &tp.max_views, &tp.expiresdt, &tp.pinned)
+		if err != nil {
+			logerr("find_descendant_txtpages", err)
+			return nil, Z_DBERR
+		}
+		tt = append(tt, &tp)
+	}
+	return tt, Z_OK
+}
+
+// Return breadcrumbs and child pages of tp, or nil if tp has neither.
+// Children are the nearest existing pages below tp, so pages whose
+// intermediate parents don't exist are still listed. Private and expired
+// pages aren't listed, and don't hide the public pages below them.
+func find_page_tree(db *DB, tp *TxtPage) *PageTree {
+	var pt PageTree
+
+	for url := parent_url(tp.url); url != ""; url = parent_url(url) {
+		var parent TxtPage
+		crumb := PageCrumb{url: url, title: url[strings.LastIndex(url, "/")+1:]}
+		if find_txtpage_by_url(db, url, &parent) == Z_OK {
+			crumb.title = txtpage_list_title(&parent)
+			crumb.exists = true
+		}
+		pt.ancestors = append([]PageCrumb{crumb}, pt.ancestors...)
+	}
+
+	tt, z := find_descendant_txtpages(db, tp.url)
+	if z == Z_OK {
+		shown := TxtPages{}
+		urls := map[string]bool{}
+		for _, child := range tt {
+			if is_public_txtpage(child) && !is_txtpage_expired(child) {
+				shown = append(shown, child)
+				urls[child.url] = true
+			}
+		}
+		for _, child := range shown {
+			nearest := true
+			for url := parent_url(child.url); url != tp.url; url = parent_url(url) {
+				if urls[url] {
+					nearest = false
+					break
+				}
+			}
+			if nearest {
+				pt.children = append(pt.children, child)
+			}
+		}
+	}
+
+	if len(pt.ancestors) == 0 && len(pt.children) == 0 {
+		return nil
+	}
+	return &pt
+}
+
+func print_breadcrumbs(P PrintFunc, pt *PageTree) {
+	if pt == nil || len(pt.ancestors) == 0 {
+		return
+	}
+	P("<nav class=\"breadcrumbs\">\n")
+	for _, crumb := range pt.ancestors {
+		if crumb.exists {
+			P("    <a href=\"/%s\">%s</a> /\n", crumb.url, escape(crumb.title))
+		} else {
+			P("    %s /\n", escape(crumb.title))
+		}
+	}
+	P("</nav>\n")
+}
+
+func print_child_pages(P PrintFunc, pt *PageTree) {
+	if pt == nil || len(pt.children) == 0 {
+		return
+	}
+	P("<nav class=\"child_pages\">\n")
+	P("<h2>Pages</h2>\n")
+	P("<ul>\n")
+	for _, tp := range pt.children {
+		P("<li><a href=\"/%s\">%s</a></li>\n", tp.url, escape(tp.title))
+	}
+	P("</ul>\n")
+	P("</nav>\n")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pastes are encrypted in the browser by paste.js before they're sent. The
+// key is only in the #fragment of the paste link, which browsers don't send
+// to the server, so the server only ever has the ciphertext.
+const PASTE_PATH = "/paste/"
+
+// Largest paste form accepted, ciphertext included.
+const MAX_PASTE_BYTES = 1 << 20
+
+// AES-GCM nonce and tag bytes around the paste ciphertext.
+const PASTE_OVERHEAD = 12 + 16
+
+// A paste's lastreaddt is updated at most this often, so views don't each
+// write to the db.
+const PASTE_READ_INTERVAL = 24 * time.Hour
+
+// Encrypted paste. url is a random id, and data is the base64 nonce and
+// ciphertext from paste.js.
+type Paste struct {
+	paste_id   int64
+	url        string
+	data       string
+	passcode   string
+	createdt   string
+	lastreaddt string
+	version    int64
+}
+
+const PASTE_COLS = "paste_id, url, data, passcode, createdt, lastreaddt, version"
+
+func scan_paste(row RowScanner, p *Paste) error {
+	return row.Scan(&p.paste_id, &p.url, &p.data, &p.passcode, &p.createdt, &p.lastreaddt, &p.version)
+}
+
+func find_paste_by_url(db *DB, url string, p *Paste) Z {
+	s := "SELECT " + PASTE_COLS + " FROM paste WHERE url = ?"
+	err := scan_paste(sqlqueryrow(db, s, url), p)
+	if err == sql.ErrNoRows {
+		return Z_NOT_FOUND
+	}
+	if err != nil {
+		logerr("find_paste_by_url", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func create_paste(db *DB, p *Paste) Z {
+	bs := make([]byte, 8)
+	rand.Read(bs)
+	p.url = hex.EncodeToString(bs)
+	p.createdt = nowdate()
+	p.lastreaddt = p.createdt
+	p.version = 1
+	if p.passcode == "" {
+		p.passcode = random_passcode()
+	}
+
+	s := "INSERT INTO paste (url, data, passcode, createdt, lastreaddt, version) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, p.url, p.data, p.passcode, p.createdt, p.lastreaddt, p.version)
+	if err != nil {
+		logerr("create_paste", err)
+		return Z_DBERR
+	}
+	p.paste_id, _ = result.LastInsertId()
+	return Z_OK
+}
+
+// Save new data of p over the version it was loaded from.
+func edit_paste(db *DB, p *Paste) Z {
+	s := "UPDATE paste SET data = ?, version = version + 1 WHERE paste_id = ? AND version = ?"
+	result, err := sqlexec(db, s, p.data, p.paste_id, p.version)
+	if err != nil {
+		logerr("edit_paste", err)
+		return Z_DBERR
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return Z_EDIT_CONFLICT
+	}
+	p.version++
+	return Z_OK
+}
+
+func delete_paste(db *DB, paste_id int64) Z {
+	_, err := sqlexec(db, "DELETE FROM paste WHERE paste_id = ?", paste_id)
+	if err != nil {
+		logerr("delete_paste", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Record a view of p, if its lastreaddt is older than PASTE_READ_INTERVAL.
+func touch_paste(db *DB, p *Paste) Z {
+	now := time.Now()
+	s := "UPDATE paste SET lastreaddt = ? WHERE paste_id = ? AND lastreaddt < ?"
+	_, err := sqlexec(db, s, isodate(now), p.paste_id, isodate(now.Add(-PASTE_READ_INTERVAL)))
+	if err != nil {
+		logerr("touch_paste", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Delete pastes with lastreaddt before duration d ago, like inactive
+// txtpages in delete_expired_txtpages().
+func delete_pastes_before_duration(db *DB, d time.Duration) Z {
+	_, err := sqlexec(db, "DELETE FROM paste WHERE lastreaddt < ?", isodate(time.Now().Add(-d)))
+	if err != nil {
+		logerr("delete_pastes_before_duration", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return true if data looks like paste.js output. The server can't check
+// any more than that.
+func is_paste_data(data string) bool {
+	bs, err := base64.StdEncoding.DecodeString(data)
+	return err == nil && len(bs) > PASTE_OVERHEAD
+}
+
+func write_json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// /paste shows the new paste form and takes new pastes from paste.js.
+// /paste/<url> shows a paste and takes its edits and deletion.
+func (server *Server) paste_handler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Trim(strings.TrimPrefix(r.URL.Path, "/paste"), "/")
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_PASTE_BYTES)
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Paste too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if url == "" {
+		server.new_paste_handler(w, r)
+		return
+	}
+	server.view_paste_handler(w, r, url)
+}
+
+func (server *Server) new_paste_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/html")
+		print_new_paste_form(makePrintFunc(w), r.Host)
+		return
+	}
+
+	p := Paste{
+		data:     r.FormValue("data"),
+		passcode: strings.TrimSpace(r.FormValue("passcode")),
+	}
+	if !is_paste_data(p.data) {
+		http.Error(w, "Paste is empty or not encrypted.", http.StatusBadRequest)
+		return
+	}
+	z := create_paste(server.db, &p)
+	if z != Z_OK {
+		http.Error(w, z.Error(), http.StatusInternalServerError)
+		return
+	}
+	write_json(w, map[string]string{"url": PASTE_PATH + p.url, "passcode": p.passcode})
+}
+
+// Show paste at url. A post with the passcode saves new data from paste.js,
+// or deletes the paste if delete_paste is set.
+func (server *Server) view_paste_handler(w http.ResponseWriter, r *http.Request, url string) {
+	var p Paste
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	z := find_paste_by_url(server.db, url, &p)
+	if z != Z_OK && r.Method == "POST" {
+		http.Error(w, z.Error(), http.StatusNotFound)
+		return
+	}
+	if z != Z_OK {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		P := makePrintFunc(w)
+		html_print_open(P, r.Host, &HtmlMeta{title: "Paste Not Found", noindex: true})
+		print_header(P)
+		P("<p>Paste not found. It may have been deleted.</p>\n")
+		html_print_close(P)
+		return
+	}
+
+	if r.Method == "POST" {
+		if strings.TrimSpace(r.FormValue("passcode")) != p.passcode {
+			http.Error(w, Z_WRONG_PASSCODE.Error(), http.StatusForbidden)
+			return
+		}
+		if r.FormValue("delete_paste") != "" {
+			z = delete_paste(server.db, p.paste_id)
+			if z != Z_OK {
+				http.Error(w, z.Error(), http.StatusInternalServerError)
+				return
+			}
+			write_json(w, map[string]bool{"deleted": true})
+			return
+		}
+
+		p.data = r.FormValue("data")
+		p.version = int64(atoi(r.FormValue("version")))
+		if !is_paste_data(p.data) {
+			http.Error(w, "Paste is empty or not encrypted.", http.StatusBadRequest)
+			return
+		}
+		z = edit_paste(server.db, &p)
+		if z == Z_EDIT_CONFLICT {
+			http.Error(w, z.Error(), http.StatusConflict)
+			return
+		}
+		if z != Z_OK {
+			http.Error(w, z.Error(), http.StatusInternalServerError)
+			return
+		}
+		write_json(w, map[string]int64{"version": p.version})
+		return
+	}
+
+	touch_paste(server.db, &p)
+	w.Header().Set("Content-Type", "text/html")
+	print_paste(makePrintFunc(w), r.Host, &p)
+}
+
+func print_paste_noscript(P PrintFunc) {
+	P("<noscript><div class=\"txtpage_form_error\"><p>Pastes are encrypted and decrypted in your browser, which needs JavaScript.</p></div></noscript>\n")
+}
+
+func print_new_paste_form(P PrintFunc, host string) {
+	html_print_open(P, host, &HtmlMeta{title: "New encrypted paste"})
+	print_header(P)
+	P("<h2>Create an encrypted paste</h2>\n")
+	P("<p>Your text is encrypted in your browser before it's sent. The key is only in the link you share, after the #, so the server can't read the paste. Anyone with the full link can.</p>\n")
+	print_paste_noscript(P)
+	P("<form id=\"paste_new\" class=\"txtpage_form\" method=\"post\" action=\"/paste\">\n")
+	P("    <div class=\"txtpage_form_error\" hidden><p id=\"paste_error\"></p></div>\n")
+	P("    <div>\n")
+	P("        <label for=\"paste_text\">Text</label>\n")
+	P("        <textarea id=\"paste_text\" rows=\"20\" autofocus></textarea>\n")
+	P("    </div>\n")
+	P("    <div>\n")
+	P("        <label for=\"passcode\">Passcode <i>(optional, to edit or delete the paste later)</i></label>\n")
+	P("        <input id=\"passcode\" name=\"passcode\">\n")
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">Create Paste</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	P("<div id=\"paste_created\" hidden>\n")
+	P("    <h2>Paste created!</h2>\n")
+	P("    <p>Link to your paste:<br>\n")
+	P("    <a id=\"paste_link\"></a></p>\n")
+	P("    <p>Passcode: <strong><i id=\"paste_passcode\"></i></strong></p>\n")
+	P("    <p>The link is the only way to read the paste. If it's lost, the paste can't be recovered.<br>You will need the passcode to edit or delete it.</p>\n")
+	P("</div>\n")
+	P("<script src=\"/static/paste.js\" defer></script>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+// Paste ciphertext with the viewer and edit form, filled in by paste.js
+// once decrypted. Pasted text is only ever set as text, never as html.
+func print_paste(P PrintFunc, host string, p *Paste) {
+	html_print_open(P, host, &HtmlMeta{title: "Encrypted paste", noindex: true})
+	print_header(P)
+	print_paste_noscript(P)
+	P("<div id=\"paste\" class=\"paste\" data-paste=\"%s\" data-version=\"%d\">\n", escape(p.data), p.version)
+	P("<p id=\"paste_status\">Decrypting...</p>\n")
+	P("<pre id=\"paste_content\" class=\"paste_content\" hidden></pre>\n")
+	P("</div>\n")
+	P("<details id=\"paste_edit\" class=\"paste_edit\" hidden>\n")
+	P("<summary>Edit or delete this paste</summary>\n")
+	P("<form id=\"paste_edit_form\" class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", PASTE_PATH+p.url)
+	P("    <div class=\"txtpage_form_error\" hidden><p id=\"paste_error\"></p></div>\n")
+	P("    <div>\n")
+	P("        <label for=\"paste_text\">Text</label>\n")
+	P("        <textarea id=\"paste_text\" rows=\"20\"></textarea>\n")
+	P("    </div>\n")
+	P("    <div>\n")
+	P("        <label for=\"passcode\">Passcode</label>\n")
+	P("        <input id=\"passcode\" name=\"passcode\">\n")
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">Save Paste</button>\n")
+	P("        <button type=\"button\" id=\"paste_delete\">Delete Paste</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	P("</details>\n")
+	P("<script src=\"/static/paste.js\" defer></script>\n")
+	print_footer(P)
+	html_print_close(P)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Return rendered html of posted page content, for preview.js.
+func (server *Server) preview_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	tp := TxtPage{
+		content: strings.TrimSpace(r.FormValue("content")),
+		url:     sanitize_txtpage_url(r.FormValue("url")),
+		toc:     r.FormValue("toc") != "",
+	}
+	html, err := server.render_preview(&tp)
+	if err != nil {
+		http.Error(w, "Error converting txtpage.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(html))
+}
+
+// Render form content for the Preview button. Shows the error if the
+// content can't be rendered.
+func (server *Server) form_preview(tp *TxtPage) string {
+	html, err := server.render_preview(tp)
+	if err != nil {
+		return "<p>Error converting txtpage: " + escape(err.Error()) + "</p>"
+	}
+	return html
+}
+
+// Preview of form content. Without javascript the Preview button submits
+// the form, which is shown again with the preview filled in. preview.js
+// fills it in from /preview instead.
+func print_form_preview(P PrintFunc, preview string) {
+	if preview == "" {
+		P("    <div id=\"txtpage_preview\" class=\"txtpage_preview txtpage_content\" hidden></div>\n")
+		return
+	}
+	P("    <div id=\"txtpage_preview\" class=\"txtpage_preview txtpage_content\">\n")
+	P("%s\n", preview)
+	P("    </div>\n")
+}
+
+func print_form_preview_button(P PrintFunc) {
+	P("        <button type=\"submit\" name=\"preview\" value=\"1\">Preview</button>\n")
+	P("        <script src=\"/static/preview.js\" defer></script>\n")
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Days a view password unlocks a private page for.
+const VIEW_SESSION_DAYS = 7
+
+// Cookie unlocking a private page is VIEW_COOKIE_PREFIX + txtpage_id.
+const VIEW_COOKIE_PREFIX = "view_"
+
+// PBKDF2 iterations of view password hashes made before pages were
+// encrypted.
+const VIEW_PASSWORD_ITER = 100000
+
+// View password attempts allowed from one client ip each UNLOCK_WINDOW.
+// Each attempt runs scrypt, so this bounds the load one client can cause
+// as well as slowing down password guessing.
+const MAX_UNLOCKS_PER_WINDOW = 10
+const UNLOCK_WINDOW = time.Minute
+
+// UnlockLimiter counts view password attempts per client ip. Counts are
+// reset every UNLOCK_WINDOW.
+type UnlockLimiter struct {
+	mu      sync.Mutex
+	startdt time.Time
+	counts  map[string]int
+}
+
+func create_unlock_limiter() *UnlockLimiter {
+	return &UnlockLimiter{startdt: time.Now(), counts: map[string]int{}}
+}
+
+// Return true and count the attempt if ip can try another view password.
+func (ul *UnlockLimiter) allow(ip string) bool {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	if time.Since(ul.startdt) >= UNLOCK_WINDOW {
+		ul.startdt = time.Now()
+		ul.counts = map[string]int{}
+	}
+	if ul.counts[ip] >= MAX_UNLOCKS_PER_WINDOW {
+		return false
+	}
+	ul.counts[ip]++
+	return true
+}
+
+// Return the ip the request came from.
+func client_ip(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Return "scrypt$<N>$<r>$<p>$<salt>$<check>" of password for storing, and
+// the key derived from it that encrypts the page.
+func hash_view_password(password string) (string, []byte) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, check, _ := derive_key(password, salt, SCRYPT_N, SCRYPT_R, SCRYPT_P)
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", SCRYPT_N, SCRYPT_R, SCRYPT_P, hex.EncodeToString(salt), hex.EncodeToString(check)), key
+}
+
+// Return the page key and true if password matches hash from
+// hash_view_password(). Older pbkdf2 hashes match with a nil key, as their
+// pages aren't encrypted.
+func check_view_password(hash string, password string) ([]byte, bool) {
+	ss := strings.Split(hash, "$")
+	if len(ss) == 4 && ss[0] == "pbkdf2-sha256" {
+		return nil, check_pbkdf2_password(ss, password)
+	}
+	if len(ss) != 6 || ss[0] != "scrypt" {
+		return nil, false
+	}
+	n, err1 := strconv.Atoi(ss[1])
+	r, err2 := strconv.Atoi(ss[2])
+	p, err3 := strconv.Atoi(ss[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, false
+	}
+	salt, err := hex.DecodeString(ss[4])
+	if err != nil {
+		return nil, false
+	}
+	want, err := hex.DecodeString(ss[5])
+	if err != nil {
+		return nil, false
+	}
+	key, check, err := derive_key(password, salt, n, r, p)
+	if err != nil || subtle.ConstantTimeCompare(check, want) != 1 {
+		return nil, false
+	}
+	return key, true
+}
+
+func check_pbkdf2_password(ss []string, password string) bool {
+	iter, err := strconv.Atoi(ss[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(ss[2])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(ss[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2.Key([]byte(password), salt, iter, len(want), sha256.New)
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// Return the server secret called name, creating it on first use.
+func load_secret(db *DB, name string) ([]byte, error) {
+	bs := make([]byte, 32)
+	rand.Read(bs)
+	_, err := sqlexec(db, "INSERT OR IGNORE INTO secret (name, value) VALUES (?, ?)", name, bs)
+	if err != nil {
+		return nil, err
+	}
+	var secret []byte
+	err = sqlqueryrow(db, "SELECT value FROM secret WHERE name = ?", name).Scan(&secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Set tp's view password and key from the create or edit form. Leaving
+// the field empty keeps the current one.
+func form_view_password(r *http.Request, tp *TxtPage) {
+	password := r.FormValue("new_view_password")
+	if password != "" {
+		tp.view_password, tp.key = hash_view_password(password)
+	} else if r.FormValue("remove_view_password") != "" {
+		tp.view_password = ""
+		tp.key = nil
+	}
+}
+
+// Return true if tp is neither private nor self-destructing, so it can be
+// shown in lists and included in other pages.
+func is_public_txtpage(tp *TxtPage) bool {
+	return tp.view_password == "" && tp.max_views == 0
+}
+
+// Keep only public pages.
+func public_txtpages(tt TxtPages) TxtPages {
+	pp := TxtPages{}
+	for _, tp := range tt {
+		if is_public_txtpage(tp) {
+			pp = append(pp, tp)
+		}
+	}
+	return pp
+}
+
+// Title, desc and content of tp as stored. Pages with a key are encrypted
+// with it.
+func stored_txtpage_text(tp *TxtPage) (string, string, string, error) {
+	if tp.key == nil {
+		return tp.title, tp.desc, tp.content, nil
+	}
+	title, err := encrypt_text(tp.key, tp.title)
+	if err != nil {
+		return "", "", "", err
+	}
+	desc, err := encrypt_text(tp.key, tp.desc)
+	if err != nil {
+		return "", "", "", err
+	}
+	content, err := encrypt_text(tp.key, tp.content)
+	if err != nil {
+		return "", "", "", err
+	}
+	return title, desc, content, nil
+}
+
+// Decrypt the title, desc and content of tp with key. tp keeps the key, so
+// it's encrypted again when saved. Older encrypted pages keep a plain desc
+// until they're saved again.
+func unlock_txtpage(tp *TxtPage, key []byte) error {
+	tp.key = key
+	if !tp.encrypted {
+		return nil
+	}
+	title, err := decrypt_text(key, tp.title)
+	if err != nil {
+		return err
+	}
+	content, err := decrypt_text(key, tp.content)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(tp.desc, ENCRYPTED_PREFIX) {
+		tp.desc, err = decrypt_text(key, tp.desc)
+		if err != nil {
+			return err
+		}
+	}
+	tp.title = title
+	tp.content = content
+	return nil
+}
+
+// Title of tp for lists and links. Encrypted pages that aren't unlocked
+// show the last segment of their url instead.
+func txtpage_list_title(tp *TxtPage) string {
+	if tp.encrypted && tp.key == nil {
+		return tp.url[strings.LastIndex(tp.url, "/")+1:]
+	}
+	return tp.title
+}
+
+// Encrypt private page tp, made before pages were encrypted, with a key
+// derived from its view password. The view password is rehashed to get the
+// key.
+func encrypt_txtpage(db *DB, tp *TxtPage, password string) Z {
+	etp := *tp
+	etp.view_password, etp.key = hash_view_password(password)
+	title, desc, content, err := stored_txtpage_text(&etp)
+	if err != nil {
+		logerr("encrypt_txtpage", err)
+		return Z_DBERR
+	}
+
+	err = db.write(func(tx *Tx) error {
+		s := "UPDATE txtpage SET title = ?, desc = ?, content = ?, view_password = ?, encrypted = 1 WHERE txtpage_id = ? AND version = ? AND view_password = ?"
+		result, err := txexec(tx, s, title, desc, content, etp.view_password, tp.txtpage_id, tp.version, tp.view_password)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return Z_EDIT_CONFLICT
+		}
+		_, err = txexec(tx, "UPDATE txtpage_revision SET content = ? WHERE txtpage_id = ? AND version = ?", content, tp.txtpage_id, tp.version)
+		if err != nil {
+			return err
+		}
+		return delete_page_history(tx, tp.txtpage_id, tp.version, tp.url)
+	})
+	if err == Z_EDIT_CONFLICT {
+		return Z_EDIT_CONFLICT
+	}
+	if err != nil {
+		logerr("encrypt_txtpage", err)
+		return Z_DBERR
+	}
+	etp.encrypted = true
+	*tp = etp
+	z := save_txtpage_tags(db, tp)
+	if z != Z_OK {
+		return z
+	}
+	return save_txtpage_links(db, tp)
+}
+
+// Additional data of a view cookie for tp expiring at unix time expires.
+// Changing the view password invalidates earlier cookies.
+func view_cookie_ad(tp *TxtPage, expires int64) []byte {
+	return []byte(fmt.Sprintf("%d|%d|%s", tp.txtpage_id, expires, tp.view_password))
+}
+
+// Return the page key and true if tp has no view password or the request
+// has a valid view cookie for it. The cookie holds the page key, encrypted
+// with the server secret.
+func (server *Server) has_view_access(r *http.Request, tp *TxtPage) ([]byte, bool) {
+	if tp.view_password == "" {
+		return nil, true
+	}
+	c, err := r.Cookie(fmt.Sprintf("%s%d", VIEW_COOKIE_PREFIX, tp.txtpage_id))
+	if err != nil {
+		return nil, false
+	}
+	sexpires, ssealed, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(sexpires, 10, 64)
+	if err != nil || expires < time.Now().Unix() {
+		return nil, false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(ssealed)
+	if err != nil {
+		return nil, false
+	}
+	key, err := unseal(server.secret, sealed, view_cookie_ad(tp, expires))
+	if err != nil {
+		return nil, false
+	}
+	if len(key) == 0 {
+		// Unlocked before the page was encrypted.
+		if tp.encrypted {
+			return nil, false
+		}
+		key = nil
+	}
+	return key, true
+}
+
+func (server *Server) set_view_cookie(w http.ResponseWriter, r *http.Request, tp *TxtPage, key []byte) {
+	expires := time.Now().Add(days_to_duration(VIEW_SESSION_DAYS)).Unix()
+	sealed, err := seal(server.secret, key, view_cookie_ad(tp, expires))
+	if err != nil {
+		logerr("set_view_cookie", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     fmt.Sprintf("%s%d", VIEW_COOKIE_PREFIX, tp.txtpage_id),
+		Value:    fmt.Sprintf("%d.%s", expires, base64.RawURLEncoding.EncodeToString(sealed)),
+		Path:     "/",
+		MaxAge:   int(days_to_duration(VIEW_SESSION_DAYS).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Return true if the request can see tp, decrypting it if needed. Private
+// pages are sent with noindex and no-store headers. Without access, the
+// view password form is shown instead, which unlocks the page and reloads
+// the request url. Pages that aren't encrypted can also be unlocked with
+// any of the page's passcodes.
+func (server *Server) check_view_access(w http.ResponseWriter, r *http.Request, tp *TxtPage) bool {
+	if tp.view_password == "" {
+		return true
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if key, ok := server.has_view_access(r, tp); ok {
+		err := unlock_txtpage(tp, key)
+		if err != nil {
+			logerr("check_view_access", err)
+			http.Error(w, "Page can't be decrypted.", http.StatusInternalServerError)
+			return false
+		}
+		return true
+	}
+
+	wrong := false
+	if r.Method == "POST" && r.FormValue("view_unlock") != "" {
+		if !server.unlocks.allow(client_ip(r)) {
+			http.Error(w, "Too many password attempts, please try again in a minute.", http.StatusTooManyRequests)
+			return false
+		}
+		password := r.FormValue("view_password")
+		key, ok := check_view_password(tp.view_password, password)
+		if ok && key == nil {
+			// Encrypt pages made private before encryption on first unlock.
+			if encrypt_txtpage(server.db, tp, password) == Z_OK {
+				server.gm.commit_page("edit", tp, "")
+				server.cache.invalidate(tp.url)
+				key = tp.key
+			}
+		}
+		if !ok && !tp.encrypted && find_credential(server.db, tp, password) != nil {
+			ok = true
+		}
+		if ok {
+			server.set_view_cookie(w, r, tp, key)
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return false
+		}
+		wrong = true
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+	print_view_password_form(P, r.Host, r.URL.RequestURI(), wrong)
+	return false
+}
+
+func print_view_password_form(P PrintFunc, host string, actionpath string, wrong bool) {
+	html_print_open(P, host, &HtmlMeta{title: "Private Page", noindex: true})
+	print_header(P)
+	P("<h2>Private page</h2>\n")
+	P("<p>This page is private. Enter its view password to read it.</p>\n")
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", escape(actionpath))
+	P("    <input type=\"hidden\" name=\"view_unlock\" value=\"1\">\n")
+	P("    <div>\n")
+	if wrong {
+		P("        <label for=\"view_password\">Incorrect password, please re-enter</label>\n")
+		P("        <input id=\"view_password\" class=\"highlight\" type=\"password\" name=\"view_password\" autofocus>\n")
+	} else {
+		P("        <label for=\"view_password\">View password</label>\n")
+		P("        <input id=\"view_password\" type=\"password\" name=\"view_password\" autofocus>\n")
+	}
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">View Page</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	print_footer(P)
+	html_print_close(P)
+}
+
+// View password field of the create or edit form. password is the new
+// password entered, shown again if the form didn't save.
+func print_form_view_password(P PrintFunc, tp *TxtPage, password string) {
+	P("    <div>\n")
+	if tp.view_password != "" && password == "" {
+		P("        <label for=\"new_view_password\">New view password <i>(leave empty to keep the current one)</i></label>\n")
+	} else {
+		P("        <label for=\"new_view_password\">View password <i>(optional, only people with it can read the page)</i></label>\n")
+	}
+	P("        <input id=\"new_view_password\" type=\"password\" name=\"new_view_password\" autocomplete=\"new-password\" value=\"%s\">\n", escape(password))
+	P("    </div>\n")
+	if tp.view_password != "" && password == "" {
+		print_form_checkbox(P, "remove_view_password", "Remove the view password and make the page public", false)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type SearchResult struct {
+	title   string
+	url     string
+	snippet string
+}
+
+// Search results per page
+const SEARCH_LIMIT = 20
+
+// Markers around matched terms in title and snippet, replaced by <mark>
+// after the text is html escaped.
+const SEARCH_MARK_START = "\x02"
+const SEARCH_MARK_END = "\x03"
+
+// Convert user search input to an fts5 query. Each word is quoted so that
+// fts5 syntax chars in the input are matched literally. All words must match.
+func fts_query(q string) string {
+	terms := []string{}
+	for _, w := range strings.Fields(q) {
+		terms = append(terms, "\""+strings.ReplaceAll(w, "\"", "\"\"")+"\"")
+	}
+	return strings.Join(terms, " ")
+}
+
+// Return pages matching q, best matches first. Pages opted out of search
+// are only included if include_unsearchable is set. Private and
+// self-destructing pages are never included, as their snippets would give
+// their content away.
+func search_txtpages(db *DB, q string, include_unsearchable bool, offset int) ([]SearchResult, Z) {
+	ftsq := fts_query(q)
+	if ftsq == "" {
+		return nil, Z_OK
+	}
+
+	// Weight title matches highest, then desc, author and content.
+	s := `SELECT highlight(txtpage_fts, 0, char(2), char(3)), t.url, snippet(txtpage_fts, 3, char(2), char(3), '...', 24)
+FROM txtpage_fts INNER JOIN txtpage t ON t.txtpage_id = txtpage_fts.rowid
+WHERE txtpage_fts MATCH ? AND t.view_password = '' AND t.max_views = 0 AND ` + NOT_EXPIRED_SQL + ` AND (t.searchable = 1 OR ?)
+ORDER BY bm25(txtpage_fts, 10.0, 5.0, 2.0, 1.0)
+LIMIT ? OFFSET ?`
+	rows, err := sqlquery(db, s, ftsq, nowdate(), include_unsearchable, SEARCH_LIMIT+1, offset)
+	if err != nil {
+		logerr("search_txtpages", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	rr := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		err := rows.Scan(&r.title, &r.url, &r.snippet)
+		if err != nil {
+			logerr("search_txtpages", err)
+			return nil, Z_DBERR
+		}
+		rr = append(rr, r)
+	}
+	return rr, Z_OK
+}
+
+// Html escape search result text and highlight the matched terms.
+func search_mark(s string) string {
+	s = escape(s)
+	s = strings.ReplaceAll(s, SEARCH_MARK_START, "<mark>")
+	s = strings.ReplaceAll(s, SEARCH_MARK_END, "</mark>")
+	return s
+}
+
+func (server *Server) search_handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	q := strings.TrimSpace(r.FormValue("q"))
+	offset := atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	html_print_open(P, r.Host, &HtmlMeta{title: "Search txtpages"})
+	print_header(P)
+	print_search_form(P, "/search", q)
+	print_search_results(P, server.db, "/search", q, false, offset)
+	print_footer(P)
+	html_print_close(P)
+}
+
+func print_search_form(P PrintFunc, actionpath string, q string) {
+	P("<form class=\"search_form\" method=\"get\" action=\"%s\">\n", actionpath)
+	P("    <input name=\"q\" value=\"%s\" placeholder=\"Search txtpages\" autofocus>\n", escape(q))
+	P("    <button type=\"submit\">Search</button>\n")
+	P("</form>\n")
+}
+
+func print_search_results(P PrintFunc, db *DB, actionpath string, q string, include_unsearchable bool, offset int) {
+	if q == "" {
+		return
+	}
+	rr, z := search_txtpages(db, q, include_unsearchable, offset)
+	if z != Z_OK {
+		P("<p>Error searching txtpages: %s</p>\n", z.Error())
+		return
+	}
+	if len(rr) == 0 {
+		P("<p>No txtpages found.</p>\n")
+		return
+	}
+
+	// One extra result is queried to tell if there's a next page.
+	more := false
+	if len(rr) > SEARCH_LIMIT {
+		rr = rr[:SEARCH_LIMIT]
+		more = true
+	}
+	P("<div class=\"search_results\">\n")
+	for _, sr := range rr {
+		P("<div class=\"search_result\">\n")
+		P("    <p><a href=\"/%s\">%s</a></p>\n", sr.url, search_mark(sr.title))
+		P("    <p>%s</p>\n", search_mark(sr.snippet))
+		P("</div>\n")
+	}
+	P("</div>\n")
+	if more {
+		P("<p><a href=\"%s?q=%s&amp;offset=%d\">More results</a></p>\n", actionpath, qescape(q), offset+SEARCH_LIMIT)
+	}
+}
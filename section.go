@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Hash of section text, to tell if the section changed while being edited.
+func section_hash(section string) string {
+	sum := sha256.Sum256([]byte(section))
+	return hex.EncodeToString(sum[:])
+}
+
+// Edit the section of tp under its top level heading i, up to the next
+// heading of the same or higher level. The rest of the page is unchanged.
+func (server *Server) edit_section_handler(w http.ResponseWriter, r *http.Request, tp *TxtPage, i int) {
+	var z Z
+	var passcode string
+	var fvalidate bool
+	var cred *Credential
+	var conflict *EditConflict
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	hh := md_heading_positions(nil, []byte(tp.content))
+	if i < 0 || i >= len(hh) {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Section Not Found"})
+		print_header(P)
+		P("<p>Section not found. <a href=\"%s\">Edit the whole page</a></p>\n", action_href("edit", tp.url))
+		html_print_close(P)
+		return
+	}
+	start, end := md_section_bounds(hh, i, len(tp.content))
+	section := tp.content[start:end]
+	hash := section_hash(section)
+	content := strings.TrimSpace(section)
+
+	if r.Method == "POST" {
+		oldurl := tp.url
+		content = strings.TrimSpace(r.FormValue("content"))
+		passcode = strings.TrimSpace(r.FormValue("passcode"))
+		cred = find_credential(server.db, tp, passcode)
+
+		for {
+			if cred == nil {
+				fvalidate = true
+				break
+			}
+			// Section was edited since the form was loaded. The form is
+			// shown again with the changes merged, and the current section
+			// index and hash so saving the merged section goes through. If
+			// the section can't be found, the whole page is merged instead.
+			if r.FormValue("hash") != hash {
+				version := int64(atoi(r.FormValue("version")))
+				j, c := server.merge_section_edit(tp, i, version, content)
+				if c == nil {
+					server.print_section_page_conflict(P, r, tp, i, version, content, passcode, cred)
+					return
+				}
+				i = j
+				start, end = md_section_bounds(hh, i, len(tp.content))
+				hash = section_hash(tp.content[start:end])
+				conflict = c
+				content = c.merged
+				z = Z_EDIT_CONFLICT
+				fvalidate = true
+				break
+			}
+			newcontent := tp.content[:start] + content + "\n\n" + tp.content[end:]
+			newcontent = strings.TrimSpace(newcontent)
+			if newcontent == "" {
+				fvalidate = true
+				break
+			}
+			saved := *tp
+			tp.content = newcontent
+			z = check_edit(cred, &saved, tp)
+			if z == Z_OK {
+				z = edit_txtpage(server.db, tp, cred)
+			}
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			server.gm.commit_page("edit", tp, oldurl)
+			server.cache.invalidate(tp.url, oldurl)
+			print_save_page_success(P, r.Host, tp, cred.passcode, r)
+			return
+		}
+	}
+
+	print_edit_section_form(P, r.Host, tp, i, content, hash, fvalidate, z, passcode, cred, conflict)
+}
+
+// Merge mine, the edit of section i of tp as of version, with the same
+// section as saved now. Sections may have been added or removed above it,
+// so it's found by its heading id rather than its index. Returns the index
+// of the section in the saved page, or a nil conflict if the base revision
+// or the section can't be found.
+func (server *Server) merge_section_edit(tp *TxtPage, i int, version int64, mine string) (int, *EditConflict) {
+	basepage, z := find_txtpage_revision(server.db, tp, version)
+	if z != Z_OK {
+		return 0, nil
+	}
+	bh := md_heading_positions(nil, []byte(basepage))
+	if i < 0 || i >= len(bh) || bh[i].id == "" {
+		return 0, nil
+	}
+	start, end := md_section_bounds(bh, i, len(basepage))
+	base := strings.TrimSpace(basepage[start:end])
+
+	hh := md_heading_positions(nil, []byte(tp.content))
+	for j, h := range hh {
+		if h.id != bh[i].id || h.level != bh[i].level {
+			continue
+		}
+		start, end := md_section_bounds(hh, j, len(tp.content))
+		theirs := strings.TrimSpace(tp.content[start:end])
+		merged, clean := merge3(base, mine, theirs)
+		return j, &EditConflict{mine: mine, theirs: theirs, merged: merged, clean: clean}
+	}
+	return 0, nil
+}
+
+// Show the edit of section i of tp as of version merged into the whole
+// page, in the full edit form. Used when the section can't be found in the
+// saved page any more. If the base revision is no longer kept, all changes
+// conflict.
+func (server *Server) print_section_page_conflict(P PrintFunc, r *http.Request, tp *TxtPage, i int, version int64, mine string, passcode string, cred *Credential) {
+	basepage := ""
+	minepage := mine
+	content, z := find_txtpage_revision(server.db, tp, version)
+	if z == Z_OK {
+		bh := md_heading_positions(nil, []byte(content))
+		if i >= 0 && i < len(bh) {
+			start, end := md_section_bounds(bh, i, len(content))
+			basepage = content
+			minepage = strings.TrimSpace(content[:start] + mine + "\n\n" + content[end:])
+		}
+	}
+	merged, clean := merge3(basepage, minepage, tp.content)
+	conflict := &EditConflict{mine: minepage, theirs: tp.content, merged: merged, clean: clean}
+
+	ftp := *tp
+	ftp.content = merged
+	sv := server.suggestions_view(tp, cred, 0, "")
+	av := server.access_view(tp, cred, "")
+	print_edit_page_form(P, r.Host, &ftp, action_href("edit", tp.url), true, Z_EDIT_CONFLICT, passcode, conflict, "", nil, sv, av, "")
+}
+
+func print_edit_section_form(P PrintFunc, host string, tp *TxtPage, i int, content string, hash string, fvalidate bool, zresult Z, passcode string, cred *Credential, conflict *EditConflict) {
+	var errmsg string
+
+	if fvalidate {
+		if zresult != Z_OK && conflict == nil {
+			errmsg = zresult.Error()
+		}
+	}
+
+	m := HtmlMeta{
+		title:       "Edit section",
+		description: TXTPAGES_TITLE,
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, host, &m)
+	print_header(P)
+	P("<h2>Edit section of <a href=\"/%s\">%s</a></h2>\n", tp.url, escape(tp.title))
+	P("<p><a href=\"%s\">Edit the whole page</a></p>\n", action_href("edit", tp.url))
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", action_href("edit", tp.url))
+	P("    <input type=\"hidden\" name=\"section\" value=\"%d\">\n", i)
+	P("    <input type=\"hidden\" name=\"hash\" value=\"%s\">\n", hash)
+	P("    <input type=\"hidden\" name=\"version\" value=\"%d\">\n", tp.version)
+	if errmsg != "" {
+		P("    <div class=\"txtpage_form_error\">\n")
+		P("        <p>%s</p>\n", errmsg)
+		P("    </div>\n")
+	}
+	print_edit_conflict(P, conflict)
+	P("    <div>\n")
+	if fvalidate && content == "" && cred != nil {
+		P("        <label for=\"content\">Please enter Content, a page can't be empty</label>\n")
+		P("        <textarea id=\"content\" name=\"content\" rows=\"20\" class=\"highlight\" autofocus>%s</textarea>\n", escape(content))
+	} else {
+		P("        <label for=\"content\">Section <i>(clear to remove the section)</i></label>\n")
+		P("        <textarea id=\"content\" name=\"content\" rows=\"20\">%s</textarea>\n", escape(content))
+	}
+	P("    </div>\n")
+	P("    <div>\n")
+	if fvalidate && cred == nil {
+		P("        <label for=\"passcode\">Incorrect passcode, please re-enter</label>\n")
+		P("        <input id=\"passcode\" class=\"highlight\" autofocus name=\"passcode\" value=\"%s\">\n", escape(passcode))
+	} else {
+		P("        <label for=\"passcode\">Enter passcode</label>\n")
+		P("        <input id=\"passcode\" name=\"passcode\" value=\"%s\">\n", escape(passcode))
+	}
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">Save Section</button>\n")
+	P("    </div>\n")
+	P("</form>\n")
+	html_print_close(P)
+}
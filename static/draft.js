@@ -0,0 +1,101 @@
+// Save the create or edit form as a server side draft a few seconds after
+// each change, so unsaved changes can be restored when the form is reopened.
+// Passcodes and passwords are never sent. Once a view password is entered,
+// the draft already saved is deleted and nothing more is saved.
+(function() {
+    var page = document.querySelector("input[name=draft_page]");
+    if (!page || !window.fetch || !window.URLSearchParams || !window.FormData) {
+        return;
+    }
+    var form = page.form;
+    var DELAY = 3000;
+    var timer = null;
+    var saved = "";
+    var discarded = false;
+
+    function private_page() {
+        var pw = form.elements["new_view_password"];
+        return pw && pw.value != "";
+    }
+
+    function form_data() {
+        var data = new URLSearchParams();
+        new FormData(form).forEach(function(v, k) {
+            if (k != "passcode" && k != "new_view_password") {
+                data.append(k, v);
+            }
+        });
+        return data.toString();
+    }
+
+    // Delete the draft saved before the view password was entered.
+    function discard() {
+        if (discarded) {
+            return;
+        }
+        discarded = true;
+        saved = "";
+        var data = new URLSearchParams();
+        data.append("draft_page", page.value);
+        data.append("discard_draft", "1");
+        fetch("/draft", {
+            method: "POST",
+            headers: {"Content-Type": "application/x-www-form-urlencoded"},
+            body: data.toString(),
+            redirect: "manual",
+        }).catch(function() {});
+    }
+
+    function save() {
+        timer = null;
+        // Private pages aren't saved as drafts.
+        if (private_page()) {
+            discard();
+            return;
+        }
+        discarded = false;
+        var body = form_data();
+        if (body == saved) {
+            return;
+        }
+        fetch("/draft", {
+            method: "POST",
+            headers: {"Content-Type": "application/x-www-form-urlencoded"},
+            body: body,
+        }).then(function(resp) {
+            if (resp.ok) {
+                saved = body;
+            }
+        }).catch(function() {});
+    }
+
+    function changed(e) {
+        if (e.target.name == "new_view_password" && private_page()) {
+            if (timer) {
+                clearTimeout(timer);
+                timer = null;
+            }
+            discard();
+            return;
+        }
+        if (e.target.name == "passcode" || e.target.name == "new_view_password") {
+            return;
+        }
+        if (timer) {
+            clearTimeout(timer);
+        }
+        timer = setTimeout(save, DELAY);
+    }
+
+    saved = form_data();
+    form.addEventListener("input", changed);
+    form.addEventListener("change", changed);
+
+    // Don't save a draft of the form being submitted.
+    form.addEventListener("submit", function() {
+        if (timer) {
+            clearTimeout(timer);
+            timer = null;
+        }
+    });
+})();
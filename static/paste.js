@@ -0,0 +1,209 @@
+// Encrypt pastes with AES-GCM before they're sent, and decrypt them for
+// viewing. The key is only kept in the link's #fragment, which browsers
+// don't send to the server. Pasted text is only ever shown as text.
+(function() {
+    var subtle = window.crypto && window.crypto.subtle;
+    var newform = document.getElementById("paste_new");
+    var paste = document.getElementById("paste");
+    var errmsg = document.getElementById("paste_error");
+
+    function show_error(msg) {
+        errmsg.textContent = msg;
+        errmsg.parentNode.hidden = false;
+    }
+
+    if (!subtle || !window.fetch || !window.URLSearchParams || !window.TextEncoder) {
+        if (paste) {
+            document.getElementById("paste_status").textContent = "Your browser can't decrypt pastes.";
+        } else if (newform) {
+            show_error("Your browser can't encrypt pastes.");
+        }
+        return;
+    }
+
+    function b64encode(bytes) {
+        var s = "";
+        for (var i = 0; i < bytes.length; i++) {
+            s += String.fromCharCode(bytes[i]);
+        }
+        return btoa(s);
+    }
+
+    function b64decode(s) {
+        var bin = atob(s);
+        var bytes = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            bytes[i] = bin.charCodeAt(i);
+        }
+        return bytes;
+    }
+
+    // Keys in links use url safe base64 without padding.
+    function key_to_fragment(raw) {
+        return b64encode(raw).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function fragment_to_key(s) {
+        s = s.replace(/-/g, "+").replace(/_/g, "/");
+        while (s.length % 4) {
+            s += "=";
+        }
+        return b64decode(s);
+    }
+
+    function import_key(raw) {
+        return subtle.importKey("raw", raw, "AES-GCM", false, ["encrypt", "decrypt"]);
+    }
+
+    // Return base64 of a random nonce followed by the ciphertext of text.
+    function encrypt(key, text) {
+        var iv = window.crypto.getRandomValues(new Uint8Array(12));
+        return subtle.encrypt({name: "AES-GCM", iv: iv}, key, new TextEncoder().encode(text))
+            .then(function(ct) {
+                var out = new Uint8Array(iv.length + ct.byteLength);
+                out.set(iv);
+                out.set(new Uint8Array(ct), iv.length);
+                return b64encode(out);
+            });
+    }
+
+    function decrypt(key, data) {
+        var bytes = b64decode(data);
+        return subtle.decrypt({name: "AES-GCM", iv: bytes.slice(0, 12)}, key, bytes.slice(12))
+            .then(function(pt) {
+                return new TextDecoder().decode(pt);
+            });
+    }
+
+    function post(url, data) {
+        return fetch(url, {method: "POST", body: data}).then(function(resp) {
+            if (!resp.ok) {
+                return resp.text().then(function(msg) {
+                    throw new Error(msg.trim() || resp.statusText);
+                });
+            }
+            return resp.json();
+        });
+    }
+
+    function create_paste(form) {
+        var button = form.querySelector("button[type=submit]");
+        form.addEventListener("submit", function(e) {
+            e.preventDefault();
+            var text = document.getElementById("paste_text").value;
+            if (text.trim() == "") {
+                show_error("Please enter some text");
+                return;
+            }
+            var raw = window.crypto.getRandomValues(new Uint8Array(32));
+            button.disabled = true;
+            import_key(raw)
+                .then(function(key) {
+                    return encrypt(key, text);
+                })
+                .then(function(data) {
+                    var body = new URLSearchParams();
+                    body.append("data", data);
+                    body.append("passcode", form.elements["passcode"].value);
+                    return post(form.action, body);
+                })
+                .then(function(res) {
+                    var link = location.origin + res.url + "#" + key_to_fragment(raw);
+                    var a = document.getElementById("paste_link");
+                    a.href = link;
+                    a.textContent = link;
+                    document.getElementById("paste_passcode").textContent = res.passcode;
+                    form.hidden = true;
+                    document.getElementById("paste_created").hidden = false;
+                })
+                .catch(function(err) {
+                    show_error("Paste failed: " + err.message);
+                    button.disabled = false;
+                });
+        });
+    }
+
+    function show_paste(el) {
+        var status = document.getElementById("paste_status");
+        var content = document.getElementById("paste_content");
+        var edit = document.getElementById("paste_edit");
+        var form = document.getElementById("paste_edit_form");
+        var text = document.getElementById("paste_text");
+
+        var raw;
+        try {
+            raw = fragment_to_key(location.hash.slice(1));
+        } catch (err) {
+            raw = null;
+        }
+        if (!raw || raw.length != 32) {
+            status.textContent = "This link is missing its key after the #, so the paste can't be decrypted.";
+            return;
+        }
+
+        import_key(raw).then(function(key) {
+            return decrypt(key, el.dataset.paste).then(function(pt) {
+                status.hidden = true;
+                content.textContent = pt;
+                content.hidden = false;
+                text.value = pt;
+                edit.hidden = false;
+                edit_paste(key, el, form, content, text);
+            });
+        }).catch(function() {
+            status.textContent = "This paste can't be decrypted. Check that the link is complete.";
+        });
+    }
+
+    function edit_paste(key, el, form, content, text) {
+        var deletebutton = document.getElementById("paste_delete");
+
+        form.addEventListener("submit", function(e) {
+            e.preventDefault();
+            encrypt(key, text.value)
+                .then(function(data) {
+                    var body = new URLSearchParams();
+                    body.append("data", data);
+                    body.append("passcode", form.elements["passcode"].value);
+                    body.append("version", el.dataset.version);
+                    return post(form.action, body);
+                })
+                .then(function(res) {
+                    el.dataset.version = res.version;
+                    content.textContent = text.value;
+                    errmsg.parentNode.hidden = true;
+                    form.parentNode.open = false;
+                })
+                .catch(function(err) {
+                    show_error("Save failed: " + err.message);
+                });
+        });
+
+        deletebutton.addEventListener("click", function() {
+            if (!window.confirm("Delete this paste? This can't be undone.")) {
+                return;
+            }
+            var body = new URLSearchParams();
+            body.append("delete_paste", "1");
+            body.append("passcode", form.elements["passcode"].value);
+            post(form.action, body)
+                .then(function() {
+                    content.textContent = "";
+                    content.hidden = true;
+                    form.parentNode.hidden = true;
+                    var status = document.getElementById("paste_status");
+                    status.textContent = "Paste deleted.";
+                    status.hidden = false;
+                })
+                .catch(function(err) {
+                    show_error("Delete failed: " + err.message);
+                });
+        });
+    }
+
+    if (newform) {
+        create_paste(newform);
+    } else if (paste) {
+        show_paste(paste);
+    }
+})();
@@ -0,0 +1,42 @@
+// Show the preview of the page content in place when the Preview button is
+// clicked, instead of submitting the form.
+(function() {
+    var button = document.querySelector("button[name=preview]");
+    var out = document.getElementById("txtpage_preview");
+    if (!button || !out || !window.fetch || !window.URLSearchParams) {
+        return;
+    }
+    var form = button.form;
+
+    button.addEventListener("click", function(e) {
+        e.preventDefault();
+        var data = new URLSearchParams();
+        data.append("content", form.elements["content"].value);
+        if (form.elements["url"]) {
+            data.append("url", form.elements["url"].value);
+        }
+        if (form.elements["toc"] && form.elements["toc"].checked) {
+            data.append("toc", "1");
+        }
+
+        button.disabled = true;
+        fetch("/preview", {method: "POST", body: data})
+            .then(function(resp) {
+                if (!resp.ok) {
+                    throw new Error(resp.statusText);
+                }
+                return resp.text();
+            })
+            .then(function(html) {
+                out.innerHTML = html;
+            })
+            .catch(function(err) {
+                out.textContent = "Preview failed: " + err.message;
+            })
+            .then(function() {
+                button.disabled = false;
+                out.hidden = false;
+                out.scrollIntoView({behavior: "smooth", block: "start"});
+            });
+    });
+})();
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pending suggested edits kept per page. The oldest is dropped to make room
+// for a new one, so a full queue can't block new suggestions.
+const MAX_SUGGESTIONS = 20
+
+// Suggested edits not reviewed within this many days are dropped.
+const SUGGESTION_DAYS = 30
+
+// Largest suggest form accepted.
+const MAX_SUGGESTION_BYTES = 1 << 20
+
+// Unchanged lines shown around each change in a diff.
+const DIFF_CONTEXT = 2
+
+// Edit suggested by someone without the passcode, made from page version.
+type Suggestion struct {
+	suggestion_id int64
+	txtpage_id    int64
+	version       int64
+	content       string
+	author        string
+	note          string
+	createdt      string
+}
+
+// Pending suggestion with its diff from the page version it was made from.
+// nobase is true if that version is no longer kept, and the diff is from
+// the current page instead.
+type SuggestionDiff struct {
+	sg     Suggestion
+	diff   []DiffLine
+	nobase bool
+}
+
+// Suggested edits shown on the edit page. pending is only filled in when
+// the passcode was entered. merging is the suggestion merged into the form
+// content, which is accepted when the page is saved.
+type SuggestionsView struct {
+	count   int
+	pending []SuggestionDiff
+	merging int64
+	notice  string
+}
+
+const SUGGESTION_COLS = "suggestion_id, txtpage_id, version, content, author, note, createdt"
+
+func scan_suggestion(row RowScanner, sg *Suggestion) error {
+	return row.Scan(&sg.suggestion_id, &sg.txtpage_id, &sg.version, &sg.content, &sg.author, &sg.note, &sg.createdt)
+}
+
+// Add suggestion, dropping the oldest ones of the page so it keeps at most
+// MAX_SUGGESTIONS pending.
+func create_suggestion(db *DB, sg *Suggestion) Z {
+	sg.createdt = nowdate()
+	err := db.write(func(tx *Tx) error {
+		s := "DELETE FROM suggestion WHERE txtpage_id = ? AND suggestion_id NOT IN (SELECT suggestion_id FROM suggestion WHERE txtpage_id = ? ORDER BY suggestion_id DESC LIMIT ?)"
+		_, err := txexec(tx, s, sg.txtpage_id, sg.txtpage_id, MAX_SUGGESTIONS-1)
+		if err != nil {
+			return err
+		}
+		s = "INSERT INTO suggestion (txtpage_id, version, content, author, note, createdt) VALUES (?, ?, ?, ?, ?, ?)"
+		result, err := txexec(tx, s, sg.txtpage_id, sg.version, sg.content, sg.author, sg.note, sg.createdt)
+		if err != nil {
+			return err
+		}
+		sg.suggestion_id, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		logerr("create_suggestion", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Delete suggestions made more than d ago.
+func delete_old_suggestions(db *DB, d time.Duration) Z {
+	_, err := sqlexec(db, "DELETE FROM suggestion WHERE createdt < ?", isodate(time.Now().Add(-d)))
+	if err != nil {
+		logerr("delete_old_suggestions", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+func find_suggestion(db *DB, suggestion_id int64, txtpage_id int64, sg *Suggestion) Z {
+	s := "SELECT " + SUGGESTION_COLS + " FROM suggestion WHERE suggestion_id = ? AND txtpage_id = ?"
+	err := scan_suggestion(sqlqueryrow(db, s, suggestion_id, txtpage_id), sg)
+	if err == sql.ErrNoRows {
+		return Z_NOT_FOUND
+	}
+	if err != nil {
+		logerr("find_suggestion", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return pending suggestions of page, oldest first.
+func find_suggestions(db *DB, txtpage_id int64) ([]Suggestion, Z) {
+	s := "SELECT " + SUGGESTION_COLS + " FROM suggestion WHERE txtpage_id = ? ORDER BY suggestion_id"
+	rows, err := sqlquery(db, s, txtpage_id)
+	if err != nil {
+		logerr("find_suggestions", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	sgs := []Suggestion{}
+	for rows.Next() {
+		var sg Suggestion
+		err := scan_suggestion(rows, &sg)
+		if err != nil {
+			logerr("find_suggestions", err)
+			return nil, Z_DBERR
+		}
+		sgs = append(sgs, sg)
+	}
+	return sgs, Z_OK
+}
+
+func delete_suggestion(db *DB, suggestion_id int64, txtpage_id int64) Z {
+	_, err := sqlexec(db, "DELETE FROM suggestion WHERE suggestion_id = ? AND txtpage_id = ?", suggestion_id, txtpage_id)
+	if err != nil {
+		logerr("delete_suggestion", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return page content the suggestion was made from. Returns false if that
+// revision is no longer kept.
+func (server *Server) suggestion_base(tp *TxtPage, sg *Suggestion) (string, bool) {
+	if sg.version == tp.version {
+		return tp.content, true
+	}
+	base, z := find_txtpage_revision(server.db, tp, sg.version)
+	return base, z == Z_OK
+}
+
+// Suggested edits of tp for the edit page. Diffs are only shown with a
+// correct passcode.
+func (server *Server) suggestions_view(tp *TxtPage, cred *Credential, merging int64, notice string) *SuggestionsView {
+	sgs, _ := find_suggestions(server.db, tp.txtpage_id)
+	sv := SuggestionsView{count: len(sgs), merging: merging, notice: notice}
+	if cred == nil {
+		return &sv
+	}
+	for _, sg := range sgs {
+		base, ok := server.suggestion_base(tp, &sg)
+		if !ok {
+			base = tp.content
+		}
+		sv.pending = append(sv.pending, SuggestionDiff{sg: sg, diff: line_diff(base, sg.content), nobase: !ok})
+	}
+	return &sv
+}
+
+// Return the suggestion button pressed on the edit form and its
+// suggestion id, or "" if none.
+func suggestion_action(r *http.Request) (string, int64) {
+	for _, action := range []string{"accept", "merge", "reject"} {
+		v := r.FormValue(action + "_suggestion")
+		if v != "" {
+			return action, int64(atoi(v))
+		}
+	}
+	return "", 0
+}
+
+// Suggest an edit to the page at url. Anyone can suggest an edit, which is
+// kept until the page owner accepts or rejects it.
+func (server *Server) suggest_handler(w http.ResponseWriter, r *http.Request, url string) {
+	var z Z
+	var tp TxtPage
+	var fvalidate bool
+	var preview string
+
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_SUGGESTION_BYTES)
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Suggested edit too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	z = find_txtpage_by_url(server.db, url, &tp)
+	if z == Z_OK && is_txtpage_expired(&tp) {
+		z = Z_NOT_FOUND
+	}
+	if z == Z_NOT_FOUND {
+		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Not Found"})
+		print_header(P)
+		P("<p>Page not found</p>\n")
+		html_print_close(P)
+		return
+	}
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Error"})
+		print_header(P)
+		P("<p>Error retrieving txtpage: %s</p>\n", z.Error())
+		html_print_close(P)
+		return
+	}
+	if !server.check_view_access(w, r, &tp) {
+		return
+	}
+	if !is_public_txtpage(&tp) {
+		html_print_open(P, r.Host, &HtmlMeta{title: "Suggest an edit", noindex: true})
+		print_header(P)
+		P("<p>Private and self-destructing pages don't take suggested edits.</p>\n")
+		html_print_close(P)
+		return
+	}
+
+	sg := Suggestion{txtpage_id: tp.txtpage_id, version: tp.version, content: tp.content}
+	if r.Method == "POST" {
+		// Processed as when saved, to compare with and merge into the page.
+		sg.content = process_content(strings.TrimSpace(r.FormValue("content")))
+		sg.author = strings.TrimSpace(r.FormValue("author"))
+		sg.note = strings.TrimSpace(r.FormValue("note"))
+		sg.version = int64(atoi(r.FormValue("version")))
+		if sg.version <= 0 || sg.version > tp.version {
+			sg.version = tp.version
+		}
+
+		for {
+			if r.FormValue("preview") != "" {
+				ptp := tp
+				ptp.content = sg.content
+				preview = server.form_preview(&ptp)
+				break
+			}
+			if sg.content == "" || sg.content == tp.content {
+				fvalidate = true
+				break
+			}
+			z = create_suggestion(server.db, &sg)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			print_suggest_success(P, r.Host, &tp)
+			return
+		}
+	}
+
+	print_suggest_form(P, r.Host, &tp, &sg, fvalidate, z, preview)
+}
+
+// Accept, merge or reject a suggested edit of tp from the edit form.
+// Accepting saves the suggestion merged with the current page. Merging, or
+// accepting a suggestion that conflicts with later changes, shows the
+// merged content in the edit form to be saved from there. Appenders can
+// only accept suggestions that add to the end of the page.
+func (server *Server) edit_suggestion_handler(w http.ResponseWriter, r *http.Request, tp *TxtPage) {
+	var z Z
+	var fvalidate bool
+	var merging int64
+	var notice string
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	action, id := suggestion_action(r)
+	passcode := strings.TrimSpace(r.FormValue("passcode"))
+	cred := find_credential(server.db, tp, passcode)
+
+	for {
+		if cred == nil {
+			fvalidate = true
+			break
+		}
+		var sg Suggestion
+		z = find_suggestion(server.db, id, tp.txtpage_id, &sg)
+		if z == Z_NOT_FOUND {
+			z = Z_OK
+			notice = "That suggested edit was already accepted or rejected."
+			break
+		}
+		if z != Z_OK {
+			fvalidate = true
+			break
+		}
+		if action != "accept" && cred.role == ROLE_APPENDER {
+			z = Z_APPEND_ONLY
+			fvalidate = true
+			break
+		}
+		if action == "reject" {
+			delete_suggestion(server.db, sg.suggestion_id, tp.txtpage_id)
+			notice = "Suggested edit rejected."
+			break
+		}
+
+		base, ok := server.suggestion_base(tp, &sg)
+		if !ok {
+			// Without its base, the suggestion can't be merged with
+			// changes made since, so it's only offered to edit.
+			tp.content = sg.content
+			merging = sg.suggestion_id
+			notice = "The page version this edit was suggested on is no longer available, so it can't be merged. The suggested text is in the Content below in place of the current page. Check it against the diff and save the page to accept it."
+			break
+		}
+		merged, clean := merge3(base, tp.content, sg.content)
+		if action == "accept" && clean {
+			newtp := *tp
+			newtp.content = merged
+			z = check_edit(cred, tp, &newtp)
+			if z == Z_OK {
+				z = edit_txtpage(server.db, &newtp, cred)
+			}
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			delete_suggestion(server.db, sg.suggestion_id, tp.txtpage_id)
+			server.gm.commit_page("edit", &newtp, tp.url)
+			server.cache.invalidate(newtp.url)
+			print_save_page_success(P, r.Host, &newtp, cred.passcode, r)
+			return
+		}
+
+		tp.content = merged
+		merging = sg.suggestion_id
+		if clean {
+			notice = "The suggested edit was merged into the Content below. Check it and save the page to accept it."
+		} else {
+			notice = "The suggested edit conflicts with changes made to the page since it was suggested. In the Content below, each conflict shows the page text, then the suggested text. Keep the text you want, remove the markers and save the page to accept it."
+		}
+		break
+	}
+
+	sv := server.suggestions_view(tp, cred, merging, notice)
+	av := server.access_view(tp, cred, "")
+	print_edit_page_form(P, r.Host, tp, action_href("edit", tp.url), fvalidate, z, passcode, nil, "", nil, sv, av, "")
+}
+
+func print_suggest_form(P PrintFunc, host string, tp *TxtPage, sg *Suggestion, fvalidate bool, zresult Z, preview string) {
+	var errmsg string
+
+	if fvalidate {
+		if zresult != Z_OK {
+			errmsg = zresult.Error()
+		}
+	}
+
+	m := HtmlMeta{
+		title:       "Suggest an edit",
+		description: TXTPAGES_TITLE,
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, host, &m)
+	print_header(P)
+	P("<h2>Suggest an edit to <a href=\"/%s\">%s</a></h2>\n", tp.url, escape(tp.title))
+	P("<p>Make your changes below. The page owner will review them and decide whether to accept them.</p>\n")
+	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", action_href("suggest", tp.url))
+	P("    <input type=\"hidden\" name=\"version\" value=\"%d\">\n", sg.version)
+	if errmsg != "" {
+		P("    <div class=\"txtpage_form_error\">\n")
+		P("        <p>%s</p>\n", errmsg)
+		P("    </div>\n")
+	}
+	P("    <div>\n")
+	if fvalidate && zresult == Z_OK {
+		P("        <label for=\"content\">Please change the Content to suggest an edit</label>\n")
+		P("        <textarea id=\"content\" name=\"content\" rows=\"20\" class=\"highlight\" autofocus>%s</textarea>\n", escape(sg.content))
+	} else {
+		P("        <label for=\"content\">Content</label>\n")
+		P("        <textarea id=\"content\" name=\"content\" rows=\"20\">%s</textarea>\n", escape(sg.content))
+	}
+	P("    </div>\n")
+	print_form_preview(P, preview)
+	P("    <div>\n")
+	P("        <label for=\"note\">What did you change? <i>(optional)</i></label>\n")
+	P("        <textarea id=\"note\" name=\"note\" rows=\"3\">%s</textarea>\n", escape(sg.note))
+	P("    </div>\n")
+	P("    <div>\n")
+	P("        <label for=\"author\">Your name <i>(optional)</i></label>\n")
+	P("        <input id=\"author\" name=\"author\" value=\"%s\">\n", escape(sg.author))
+	P("    </div>\n")
+	P("    <div class=\"txtpage_form_save\">\n")
+	P("        <button type=\"submit\">Suggest Edit</button>\n")
+	print_form_preview_button(P)
+	P("    </div>\n")
+	P("</form>\n")
+	html_print_close(P)
+}
+
+func print_suggest_success(P PrintFunc, host string, tp *TxtPage) {
+	html_print_open(P, host, &HtmlMeta{title: "Edit Suggested"})
+	print_header(P)
+	P("<h2>Thanks for your suggestion!</h2>\n")
+	P("<p>Your suggested edit was sent to the owner of <a href=\"/%s\">%s</a> for review.</p>\n", tp.url, escape(tp.title))
+	print_footer(P)
+	html_print_close(P)
+}
+
+// Notice about the suggestion just merged or rejected, at the top of the
+// edit form.
+func print_suggestion_notice(P PrintFunc, sv *SuggestionsView) {
+	if sv == nil {
+		return
+	}
+	if sv.merging > 0 {
+		P("    <input type=\"hidden\" name=\"suggestion\" value=\"%d\">\n", sv.merging)
+	}
+	if sv.notice == "" {
+		return
+	}
+	P("    <div class=\"suggestion_notice\">\n")
+	P("        <p>%s</p>\n", escape(sv.notice))
+	P("    </div>\n")
+}
+
+// Pending suggestions, after the save button of the edit form so that
+// pressing enter in the form still saves. Without the passcode only the
+// number waiting is shown.
+func print_form_suggestions(P PrintFunc, sv *SuggestionsView) {
+	if sv == nil || sv.count == 0 {
+		return
+	}
+	P("    <div class=\"suggestions\">\n")
+	if sv.pending == nil {
+		if sv.count == 1 {
+			P("        <p>1 suggested edit is waiting for review. Enter the passcode to see it.\n")
+		} else {
+			P("        <p>%d suggested edits are waiting for review. Enter the passcode to see them.\n", sv.count)
+		}
+		P("        <button type=\"submit\" name=\"review_suggestions\" value=\"1\">Review suggested edits</button></p>\n")
+		P("    </div>\n")
+		return
+	}
+	P("        <h3>Suggested edits</h3>\n")
+	P("        <p><i>Accept saves a suggested edit right away. Merge puts it in the Content above to change before saving. Reject deletes it.</i></p>\n")
+	for _, sd := range sv.pending {
+		sg := sd.sg
+		author := sg.author
+		if author == "" {
+			author = "Anonymous"
+		}
+		P("        <div class=\"suggestion\">\n")
+		P("            <p>Suggested by <b>%s</b> on %s</p>\n", escape(author), formatdate(sg.createdt))
+		if sg.note != "" {
+			P("            <p>%s</p>\n", escape(sg.note))
+		}
+		if sd.nobase {
+			P("            <p><i>Base revision no longer available, diff against current page.</i></p>\n")
+		}
+		print_diff(P, sd.diff)
+		P("            <p>\n")
+		P("                <button type=\"submit\" name=\"accept_suggestion\" value=\"%d\">Accept</button>\n", sg.suggestion_id)
+		P("                <button type=\"submit\" name=\"merge_suggestion\" value=\"%d\">Merge</button>\n", sg.suggestion_id)
+		P("                <button type=\"submit\" name=\"reject_suggestion\" value=\"%d\">Reject</button>\n", sg.suggestion_id)
+		P("            </p>\n")
+		P("        </div>\n")
+	}
+	P("    </div>\n")
+}
+
+// Return true if a changed line is within n lines of dd[i].
+func diff_near_change(dd []DiffLine, i int, n int) bool {
+	for j := i - n; j <= i+n; j++ {
+		if j >= 0 && j < len(dd) && dd[j].op != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+// Print changed lines with DIFF_CONTEXT unchanged lines around them.
+func print_diff(P PrintFunc, dd []DiffLine) {
+	P("<pre class=\"diff\">")
+	skipped := false
+	for i, d := range dd {
+		if d.op == ' ' && !diff_near_change(dd, i, DIFF_CONTEXT) {
+			if !skipped {
+				P("<span class=\"diff_skip\">...</span>\n")
+				skipped = true
+			}
+			continue
+		}
+		skipped = false
+		if d.op == '+' {
+			P("<ins>+ %s</ins>\n", escape(d.text))
+		} else if d.op == '-' {
+			P("<del>- %s</del>\n", escape(d.text))
+		} else {
+			P("  %s\n", escape(d.text))
+		}
+	}
+	P("</pre>\n")
+}
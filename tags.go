@@ -0,0 +1,244 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type TagCount struct {
+	tag   string
+	count int
+}
+
+const MAX_TAG_LEN = 50
+
+var tag_sep_re = regexp.MustCompile(`[\s,]+`)
+var tag_invalid_re = regexp.MustCompile(`[^\p{L}\p{N}_\-]`)
+
+// #hashtag preceded by start of line or whitespace. Markdown headings need a
+// space after the '#' so they don't match.
+var hashtag_re = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_\-]+)`)
+var code_block_re = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+
+func sanitize_tag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(tag, "#")))
+	tag = tag_invalid_re.ReplaceAllString(tag, "")
+	rr := []rune(tag)
+	if len(rr) > MAX_TAG_LEN {
+		tag = string(rr[:MAX_TAG_LEN])
+	}
+	return tag
+}
+
+// Return tags from a space or comma separated list, without duplicates.
+func parse_tags(s string) []string {
+	tags := []string{}
+	for _, tag := range tag_sep_re.Split(s, -1) {
+		tag = sanitize_tag(tag)
+		if tag == "" || ss_contains(tags, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Return #hashtags in markdown content, skipping code.
+func parse_hashtags(content string) []string {
+	content = code_block_re.ReplaceAllString(content, "")
+	tags := []string{}
+	for _, ss := range hashtag_re.FindAllStringSubmatch(content, -1) {
+		tag := sanitize_tag(ss[1])
+		if tag == "" || ss_contains(tags, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// All tags of tp: tags entered in the form followed by content hashtags.
+func txtpage_tags(tp *TxtPage) []string {
+	tags := parse_tags(tp.tags)
+	for _, tag := range parse_hashtags(tp.content) {
+		if !ss_contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Replace tags of tp within tx.
+func txsave_txtpage_tags(tx *Tx, tp *TxtPage) error {
+	tags := txtpage_tags(tp)
+	if tp.encrypted {
+		// Hashtags would give away encrypted content.
+		tags = parse_tags(tp.tags)
+	}
+	_, err := txexec(tx, "DELETE FROM txtpage_tag WHERE txtpage_id = ?", tp.txtpage_id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = txexec(tx, "INSERT INTO txtpage_tag (txtpage_id, tag) VALUES (?, ?)", tp.txtpage_id, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func save_txtpage_tags(db *DB, tp *TxtPage) Z {
+	err := db.write(func(tx *Tx) error {
+		return txsave_txtpage_tags(tx, tp)
+	})
+	if err != nil {
+		logerr("save_txtpage_tags", err)
+		return Z_DBERR
+	}
+	return Z_OK
+}
+
+// Return listed txtpages with tag, newest first.
+func find_listed_txtpages_by_tag(db *DB, tag string) (TxtPages, Z) {
+	s := "SELECT " + TXTPAGE_COLS + " FROM txtpage WHERE listed = 1 AND view_password = '' AND max_views = 0 AND " + NOT_EXPIRED_SQL + " AND txtpage_id IN (SELECT txtpage_id FROM txtpage_tag WHERE tag = ?) ORDER BY createdt DESC"
+	rows, err := sqlquery(db, s, nowdate(), tag)
+	if err != nil {
+		logerr("find_listed_txtpages_by_tag", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	tt := TxtPages{}
+	for rows.Next() {
+		var tp TxtPage
+		err := scan_txtpage(rows, &tp)
+		if err != nil {
+			logerr("find_listed_txtpages_by_tag", err)
+			return nil, Z_DBERR
+		}
+		tt = append(tt, &tp)
+	}
+	return tt, Z_OK
+}
+
+// Return tags of listed txtpages with number of pages for each, by tag name.
+func find_listed_tag_counts(db *DB) ([]TagCount, Z) {
+	s := "SELECT tag, COUNT(*) FROM txtpage_tag INNER JOIN txtpage ON txtpage.txtpage_id = txtpage_tag.txtpage_id WHERE txtpage.listed = 1 AND txtpage.view_password = '' AND txtpage.max_views = 0 AND " + NOT_EXPIRED_SQL + " GROUP BY tag ORDER BY tag"
+	rows, err := sqlquery(db, s, nowdate())
+	if err != nil {
+		logerr("find_listed_tag_counts", err)
+		return nil, Z_DBERR
+	}
+	defer rows.Close()
+
+	cc := []TagCount{}
+	for rows.Next() {
+		var tc TagCount
+		err := rows.Scan(&tc.tag, &tc.count)
+		if err != nil {
+			logerr("find_listed_tag_counts", err)
+			return nil, Z_DBERR
+		}
+		cc = append(cc, tc)
+	}
+	return cc, Z_OK
+}
+
+func tag_href(tag string) string {
+	return "/tag/" + pathescape(tag)
+}
+
+func print_txtpage_tags(P PrintFunc, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	P("<p class=\"txtpage_tags\">\n")
+	for _, tag := range tags {
+		P("    <a href=\"%s\">#%s</a>\n", tag_href(tag), escape(tag))
+	}
+	P("</p>\n")
+}
+
+// /tag shows the tag cloud, /tag/<name> lists pages tagged with name.
+func (server *Server) tag_handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+
+	tag := sanitize_tag(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/tag"), "/"))
+	if tag == "" {
+		server.print_tag_cloud(P, r.Host)
+		return
+	}
+
+	tt, z := find_listed_txtpages_by_tag(server.db, tag)
+	if z != Z_OK {
+		html_print_open(P, r.Host, &HtmlMeta{title: "DB error"})
+		print_header(P)
+		P("<p>DB error</p>\n")
+		html_print_close(P)
+		return
+	}
+
+	m := HtmlMeta{
+		title:       "#" + tag,
+		description: "Txtpages tagged #" + tag,
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, r.Host, &m)
+	print_header(P)
+	P("<h2>#%s</h2>\n", escape(tag))
+	P("<p><a href=\"/tag\">All tags</a></p>\n")
+	if len(tt) == 0 {
+		P("<p>No txtpages tagged #%s.</p>\n", escape(tag))
+	}
+	for _, tp := range tt {
+		print_directory_entry(P, tp)
+	}
+	print_footer(P)
+	html_print_close(P)
+}
+
+func (server *Server) print_tag_cloud(P PrintFunc, host string) {
+	cc, z := find_listed_tag_counts(server.db)
+	if z != Z_OK {
+		html_print_open(P, host, &HtmlMeta{title: "DB error"})
+		print_header(P)
+		P("<p>DB error</p>\n")
+		html_print_close(P)
+		return
+	}
+
+	m := HtmlMeta{
+		title:       "TxtPages Tags",
+		description: "Tags of public txtpages",
+		author:      TXTPAGES_AUTHOR,
+	}
+	html_print_open(P, host, &m)
+	print_header(P)
+	P("<h2>Tags</h2>\n")
+	if len(cc) == 0 {
+		P("<p>No tags yet.</p>\n")
+	}
+
+	// Scale font size by log of page count, from 100% to 250%.
+	maxcount := 1
+	for _, tc := range cc {
+		if tc.count > maxcount {
+			maxcount = tc.count
+		}
+	}
+	P("<p class=\"tag_cloud\">\n")
+	for _, tc := range cc {
+		pct := 100
+		if maxcount > 1 {
+			pct = 100 + int(150*math.Log(float64(tc.count))/math.Log(float64(maxcount)))
+		}
+		P("    <a href=\"%s\" style=\"font-size: %d%%\" title=\"%d pages\">#%s</a>\n", tag_href(tc.tag), pct, tc.count, escape(tc.tag))
+	}
+	P("</p>\n")
+	print_footer(P)
+	html_print_close(P)
+}
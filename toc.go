@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Paragraph replaced by the table of contents.
+const TOC_MARKER = "[TOC]"
+
+// Table of contents of the document headings.
+type Toc struct {
+	ast.BaseBlock
+	headings []MdHeading
+}
+
+var KindToc = ast.NewNodeKind("Toc")
+
+func (n *Toc) Kind() ast.NodeKind {
+	return KindToc
+}
+
+func (n *Toc) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+type tocTransformer struct{}
+
+// Replace [TOC] paragraphs with the headings of the document. Heading ids
+// are already assigned by the parser at this point.
+func (t *tocTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	markers := []ast.Node{}
+	hh := []MdHeading{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Paragraph:
+			if md_node_text(n, source) == TOC_MARKER {
+				markers = append(markers, n)
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.Heading:
+			h := MdHeading{level: n.Level, text: md_node_text(n, source)}
+			if id, ok := n.AttributeString("id"); ok {
+				if bs, ok := id.([]byte); ok {
+					h.id = string(bs)
+				}
+			}
+			hh = append(hh, h)
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, m := range markers {
+		m.Parent().ReplaceChild(m.Parent(), m, &Toc{headings: hh})
+	}
+}
+
+type tocRenderer struct {
+	section_href func(i int) string
+	included     [][2]int
+}
+
+func (r *tocRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindToc, r.render_toc)
+	reg.Register(ast.KindHeading, r.render_heading)
+}
+
+// Nested lists of headings. Levels are relative to the top heading level so
+// pages starting at ## don't get an empty outer list.
+func (r *tocRenderer) render_toc(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	hh := n.(*Toc).headings
+	if len(hh) == 0 {
+		return ast.WalkContinue, nil
+	}
+	minlevel := hh[0].level
+	for _, h := range hh {
+		if h.level < minlevel {
+			minlevel = h.level
+		}
+	}
+
+	w.WriteString("<nav class=\"toc\">\n<ul>\n")
+	depth := 0
+	open := false
+	for _, h := range hh {
+		level := h.level - minlevel
+		for ; depth < level; depth++ {
+			if !open {
+				w.WriteString("<li>")
+			}
+			w.WriteString("\n<ul>\n")
+			open = false
+		}
+		for ; depth > level; depth-- {
+			if open {
+				w.WriteString("</li>\n")
+			}
+			w.WriteString("</ul>\n")
+			open = true
+		}
+		if open {
+			w.WriteString("</li>\n")
+		}
+		fmt.Fprintf(w, "<li><a href=\"#%s\">%s</a>", escape(h.id), escape(h.text))
+		open = true
+	}
+	w.WriteString("</li>\n")
+	for ; depth > 0; depth-- {
+		w.WriteString("</ul>\n</li>\n")
+	}
+	w.WriteString("</ul>\n</nav>\n")
+	return ast.WalkContinue, nil
+}
+
+// Headings with a permalink anchor after the heading text.
+func (r *tocRenderer) render_heading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Heading)
+	if entering {
+		fmt.Fprintf(w, "<h%d", n.Level)
+		if n.Attributes() != nil {
+			html.RenderAttributes(w, node, html.HeadingAttributeFilter)
+		}
+		w.WriteByte('>')
+		return ast.WalkContinue, nil
+	}
+	if id, ok := n.AttributeString("id"); ok {
+		if bs, ok := id.([]byte); ok {
+			fmt.Fprintf(w, " <a class=\"heading_anchor\" href=\"#%s\" aria-label=\"Permalink\">#</a>", escape(string(bs)))
+		}
+	}
+	if r.section_href != nil {
+		i, ok := r.section_index(source, n)
+		if ok {
+			fmt.Fprintf(w, " <a class=\"section_edit\" href=\"%s\">edit</a>", escape(r.section_href(i)))
+		}
+	}
+	fmt.Fprintf(w, "</h%d>\n", n.Level)
+	return ast.WalkContinue, nil
+}
+
+// Return index of heading among the top level headings of the page's own
+// content, numbered the same as md_heading_positions() of the content.
+func (r *tocRenderer) section_index(source []byte, heading *ast.Heading) (int, bool) {
+	if heading.Parent() == nil || heading.Parent().Kind() != ast.KindDocument {
+		return 0, false
+	}
+	i := 0
+	for n := heading.Parent().FirstChild(); n != nil; n = n.NextSibling() {
+		h, ok := n.(*ast.Heading)
+		if !ok || h.Lines().Len() == 0 || r.is_included(h.Lines().At(0).Start) {
+			continue
+		}
+		if h == heading {
+			return i, true
+		}
+		i++
+	}
+	return 0, false
+}
+
+func (r *tocRenderer) is_included(pos int) bool {
+	for _, rr := range r.included {
+		if pos >= rr[0] && pos < rr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Goldmark extension for [TOC] tables of contents, heading permalinks and
+// section edit links.
+type TocExtension struct {
+	section_href func(i int) string
+	included     [][2]int
+}
+
+func (e *TocExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(
+		util.Prioritized(&tocTransformer{}, 500),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&tocRenderer{section_href: e.section_href, included: e.included}, 500),
+	))
+}
@@ -1,29 +1,45 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type Config struct {
-	initdbfile string
-	dbfile     string
-	port       string
+	initdbfile  string
+	dbfile      string
+	port        string
+	gitdir      string
+	backupdir   string
+	keep_daily  int
+	keep_weekly int
+	replicadir  string
+	draft_days  int
 }
 
 type Server struct {
-	db  *sql.DB
-	cfg *Config
+	db    *DB
+	cfg   *Config
+	gm    *GitMirror
+	reads *ReadBuffer
+	cache *RenderCache
+
+	// Key signing view cookies of private pages.
+	secret []byte
+
+	// View password attempts by client ip.
+	unlocks *UnlockLimiter
 }
 
 type StockPage struct {
@@ -53,12 +69,72 @@ Start webservice:
 	%[1]s <dbfile> [port]
 Initialize db file:
 	%[1]s -i <dbfile>
+Mirror page history to a git repository:
+	%[1]s <dbfile> [port] -g <gitdir>
+Rebuild git mirror from db file:
+	%[1]s gitmirror <dbfile> <gitdir>
+Back up db daily into a directory, keeping N daily and M weekly backups:
+	%[1]s <dbfile> [port] -b <backupdir> [-keep-daily N] [-keep-weekly M]
+Back up db file (dest can be a file or directory):
+	%[1]s backup <dbfile> <dest>
+Restore db file from backup:
+	%[1]s restore <backupfile> <dbfile>
+Ship db WAL to a replica directory as it is written:
+	%[1]s <dbfile> [port] -r <replicadir>
+Restore db file from replica directory, as of a time (RFC3339) or latest:
+	%[1]s restore <replicadir> <dbfile> [--to-time <time>]
+Check db file for problems, asking to repair each one (or repair all with --fix):
+	%[1]s fsck [--fix] <dbfile>
+Keep unsaved page drafts for N days (default 7):
+	%[1]s <dbfile> [port] -draft-days N
+Pin a page so it never expires, or unpin it:
+	%[1]s pin <dbfile> <url>
+	%[1]s unpin <dbfile> <url>
 `
 	if len(os.Args) <= 1 {
 		fmt.Printf(usage, os.Args[0])
 		os.Exit(0)
 	}
 
+	// Log to stderr until the server log file is opened.
+	l := log.New(os.Stderr, "", 0)
+	logprint = make_log_print_func(l)
+	logerr = make_log_err_func(l)
+
+	cmd := os.Args[1]
+	if cmd == "gitmirror" || cmd == "backup" || cmd == "restore" || cmd == "pin" || cmd == "unpin" {
+		if len(os.Args) != 4 && !(cmd == "restore" && len(os.Args) == 6 && os.Args[4] == "--to-time") {
+			fmt.Printf(usage, os.Args[0])
+			os.Exit(1)
+		}
+	}
+	if cmd == "gitmirror" {
+		os.Exit(run_gitmirror_cmd(os.Args[2], os.Args[3]))
+	}
+	if cmd == "backup" {
+		os.Exit(run_backup_cmd(os.Args[2], os.Args[3]))
+	}
+	if cmd == "pin" || cmd == "unpin" {
+		os.Exit(run_pin_cmd(os.Args[2], os.Args[3], cmd == "pin"))
+	}
+	if cmd == "fsck" {
+		if len(os.Args) == 3 {
+			os.Exit(run_fsck_cmd(os.Args[2], false))
+		}
+		if len(os.Args) == 4 && os.Args[2] == "--fix" {
+			os.Exit(run_fsck_cmd(os.Args[3], true))
+		}
+		fmt.Printf(usage, os.Args[0])
+		os.Exit(1)
+	}
+	if cmd == "restore" {
+		var totime string
+		if len(os.Args) == 6 {
+			totime = os.Args[5]
+		}
+		os.Exit(run_restore_cmd(os.Args[2], os.Args[3], totime))
+	}
+
 	var cfg Config
 	parse_args(os.Args, &cfg)
 	if cfg.initdbfile != "" {
@@ -74,13 +150,17 @@ Initialize db file:
 		fmt.Printf("dbfile '%s' doesn't exist. Create one with: %s -i <dbfile>\n", cfg.dbfile, os.Args[0])
 		os.Exit(1)
 	}
-	db, err := sql.Open("sqlite3", cfg.dbfile)
+	driver := "sqlite3"
+	if cfg.replicadir != "" {
+		driver = WALSHIP_DRIVER
+	}
+	db, err := open_db_driver(driver, cfg.dbfile)
 	if err != nil {
 		fmt.Printf("Error opening '%s' (%s)\n", cfg.dbfile, err)
 		os.Exit(1)
 	}
 
-	l, err := create_logger_from_file("log.txt")
+	l, err = create_logger_from_file("log.txt")
 	if err != nil {
 		logerr("create_logger_from_file", err)
 		panic(err)
@@ -88,38 +168,162 @@ Initialize db file:
 	logprint = make_log_print_func(l)
 	logerr = make_log_err_func(l)
 
+	err = migrate_tables(db)
+	if err != nil {
+		fmt.Printf("Error migrating '%s' (%s)\n", cfg.dbfile, err)
+		os.Exit(1)
+	}
+
 	stock_pages = load_stock_pages()
 
-	// Check and delete old pages every 24 hours
-	const TICKER_DURATION = 24 * time.Hour
+	secret, err := load_secret(db, "view_cookie")
+	if err != nil {
+		fmt.Printf("Error loading secret from '%s' (%s)\n", cfg.dbfile, err)
+		os.Exit(1)
+	}
 
-	// Delete pages with lastreaddt older than 6 months
-	CLEAR_OLD_PAGES_DURATION := days_to_duration(30) * 6
+	// Background jobs run until quit is closed. Shutdown waits for running
+	// jobs to finish before closing gm and db, which they write to.
+	quit := make(chan struct{})
+	var jobs sync.WaitGroup
+	run_every := func(d time.Duration, job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			t := time.NewTicker(d)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					job()
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
 
-	ticker := time.NewTicker(TICKER_DURATION)
-	defer ticker.Stop()
-	go func() {
-		for {
-			<-ticker.C
-			delete_txtpages_before_duration(db, CLEAR_OLD_PAGES_DURATION)
+	if cfg.replicadir != "" {
+		ws, err := start_walshipper(db, cfg.dbfile, cfg.replicadir)
+		if err != nil {
+			fmt.Printf("Error starting replication to '%s' (%s)\n", cfg.replicadir, err)
+			os.Exit(1)
 		}
-	}()
+
+		// Check every minute if it's time to start a new replica generation
+		run_every(time.Minute, func() {
+			err := ws.check_generation()
+			if err != nil {
+				logerr("check_generation", err)
+			}
+		})
+	}
+
+	var gm *GitMirror
+	if cfg.gitdir != "" {
+		gm, err = open_gitmirror(cfg.gitdir)
+		if err != nil {
+			fmt.Printf("Error opening git mirror '%s' (%s)\n", cfg.gitdir, err)
+			os.Exit(1)
+		}
+	}
+
+	// Check and delete expired and old pages every hour, so pages that
+	// expire after an hour don't stay up for much longer.
+	const TICKER_DURATION = time.Hour
+
+	// Write buffered page reads to db every 30 seconds
+	const FLUSH_READS_DURATION = 30 * time.Second
+
+	reads := create_read_buffer()
+	cache := create_render_cache()
+
+	run_every(TICKER_DURATION, func() {
+		reads.flush(db)
+		urls, _ := delete_expired_txtpages(db, CLEAR_OLD_PAGES_DURATION)
+		for _, url := range urls {
+			gm.commit_page("delete", &TxtPage{url: url}, "")
+		}
+		cache.invalidate(urls...)
+		delete_pastes_before_duration(db, CLEAR_OLD_PAGES_DURATION)
+		delete_old_drafts(db, days_to_duration(cfg.draft_days))
+		delete_old_suggestions(db, days_to_duration(SUGGESTION_DAYS))
+	})
+
+	if cfg.backupdir != "" {
+		// Back up on startup and then every 24 hours
+		backup := func() {
+			err := run_scheduled_backup(db, cfg.backupdir, cfg.keep_daily, cfg.keep_weekly)
+			if err != nil {
+				logerr("run_scheduled_backup", err)
+			}
+		}
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			backup()
+		}()
+		run_every(24*time.Hour, backup)
+	}
+
+	run_every(FLUSH_READS_DURATION, func() {
+		reads.flush(db)
+	})
 
 	rand.Seed(time.Now().UnixNano())
-	server := Server{db, &cfg}
+	server := Server{db: db, cfg: &cfg, gm: gm, reads: reads, cache: cache, secret: secret, unlocks: create_unlock_limiter()}
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 	http.HandleFunc("/$$$", server.admin_handler)
+	http.HandleFunc("/search", server.search_handler)
+	http.HandleFunc("/directory", server.directory_handler)
+	http.HandleFunc("/sitemap.xml", server.sitemap_handler)
+	http.HandleFunc("/tag", server.tag_handler)
+	http.HandleFunc("/tag/", server.tag_handler)
+	http.HandleFunc(BOOK_PATH, server.book_handler)
+	http.HandleFunc("/preview", server.preview_handler)
+	http.HandleFunc("/draft", server.draft_handler)
+	http.HandleFunc("/paste", server.paste_handler)
+	http.HandleFunc(PASTE_PATH, server.paste_handler)
 	http.HandleFunc("/", server.index_handler)
 
+	// Shut down cleanly on interrupt so buffered writes aren't lost.
+	// ListenAndServe returns as soon as Shutdown starts, so stopped is
+	// closed once running requests have finished too.
+	httpserver := &http.Server{Addr: fmt.Sprintf(":%s", cfg.port)}
+	stopped := make(chan struct{})
+	go func() {
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+		<-sigch
+		httpserver.Shutdown(context.Background())
+		close(stopped)
+	}()
+
 	fmt.Printf("Listening on %s...\n", cfg.port)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", cfg.port), nil)
-	log.Fatal(err)
+	err = httpserver.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Shutting down...\n")
+	<-stopped
+	close(quit)
+	jobs.Wait()
+	reads.flush(db)
+	gm.close()
+	db.close()
 }
 
 func parse_args(args []string, cfg *Config) {
 	const (
 		PA_NONE = iota
 		PA_INITDBFILE
+		PA_GITDIR
+		PA_BACKUPDIR
+		PA_KEEPDAILY
+		PA_KEEPWEEKLY
+		PA_REPLICADIR
+		PA_DRAFTDAYS
 	)
 
 	state := PA_NONE
@@ -132,11 +336,65 @@ func parse_args(args []string, cfg *Config) {
 			state = PA_INITDBFILE
 			continue
 		}
+		if state == PA_NONE && arg == "-g" {
+			state = PA_GITDIR
+			continue
+		}
+		if state == PA_NONE && arg == "-r" {
+			state = PA_REPLICADIR
+			continue
+		}
+		if state == PA_NONE && arg == "-b" {
+			state = PA_BACKUPDIR
+			continue
+		}
+		if state == PA_NONE && arg == "-keep-daily" {
+			state = PA_KEEPDAILY
+			continue
+		}
+		if state == PA_NONE && arg == "-keep-weekly" {
+			state = PA_KEEPWEEKLY
+			continue
+		}
+		if state == PA_NONE && arg == "-draft-days" {
+			state = PA_DRAFTDAYS
+			continue
+		}
 		if state == PA_INITDBFILE {
 			cfg.initdbfile = arg
 			state = PA_NONE
 			continue
 		}
+		if state == PA_GITDIR {
+			cfg.gitdir = arg
+			state = PA_NONE
+			continue
+		}
+		if state == PA_REPLICADIR {
+			cfg.replicadir = arg
+			state = PA_NONE
+			continue
+		}
+		if state == PA_BACKUPDIR {
+			cfg.backupdir = arg
+			state = PA_NONE
+			continue
+		}
+		if state == PA_KEEPDAILY {
+			cfg.keep_daily = atoi(arg)
+			state = PA_NONE
+			continue
+		}
+		if state == PA_KEEPWEEKLY {
+			cfg.keep_weekly = atoi(arg)
+			state = PA_NONE
+			continue
+		}
+		if state == PA_DRAFTDAYS {
+			cfg.draft_days = atoi(arg)
+			state = PA_NONE
+			continue
+		}
 		if state == PA_NONE {
 			if !dbfile_set {
 				cfg.dbfile = arg
@@ -151,6 +409,131 @@ func parse_args(args []string, cfg *Config) {
 	if !port_set {
 		cfg.port = "8000"
 	}
+	if cfg.keep_daily <= 0 {
+		cfg.keep_daily = DEFAULT_KEEP_DAILY
+	}
+	if cfg.keep_weekly <= 0 {
+		cfg.keep_weekly = DEFAULT_KEEP_WEEKLY
+	}
+	if cfg.draft_days <= 0 {
+		cfg.draft_days = DEFAULT_DRAFT_DAYS
+	}
+}
+
+func run_gitmirror_cmd(dbfile string, gitdir string) int {
+	if !file_exists(dbfile) {
+		fmt.Printf("dbfile '%s' doesn't exist.\n", dbfile)
+		return 1
+	}
+	db, err := open_db(dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	defer db.close()
+
+	err = rebuild_gitmirror(db, gitdir)
+	if err != nil {
+		fmt.Printf("Error rebuilding git mirror '%s' (%s)\n", gitdir, err)
+		return 1
+	}
+	return 0
+}
+
+func run_backup_cmd(dbfile string, dest string) int {
+	if !file_exists(dbfile) {
+		fmt.Printf("dbfile '%s' doesn't exist.\n", dbfile)
+		return 1
+	}
+	db, err := open_db(dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	defer db.close()
+
+	fi, err := os.Stat(dest)
+	if err == nil && fi.IsDir() {
+		dest = filepath.Join(dest, BACKUP_PREFIX+time.Now().UTC().Format(BACKUP_TIME_FMT)+BACKUP_EXT)
+	}
+	err = backup_db(db, dest)
+	if err != nil {
+		fmt.Printf("Error backing up '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	fmt.Printf("Backed up '%s' to '%s'\n", dbfile, dest)
+	return 0
+}
+
+func run_restore_cmd(backupfile string, dbfile string, totime string) int {
+	var err error
+
+	fi, err := os.Stat(backupfile)
+	if err != nil {
+		fmt.Printf("Error restoring '%s' (%s)\n", backupfile, err)
+		return 1
+	}
+	if fi.IsDir() {
+		// Restore from replica dir.
+		t := time.Now()
+		if totime != "" {
+			t, err = time.Parse(time.RFC3339, totime)
+			if err != nil {
+				fmt.Printf("Invalid time '%s', use format like 2006-01-02T15:04:05Z\n", totime)
+				return 1
+			}
+		}
+		err = restore_replica(backupfile, t, dbfile)
+	} else {
+		if totime != "" {
+			fmt.Printf("--to-time requires a replica directory\n")
+			return 1
+		}
+		err = restore_db(backupfile, dbfile)
+	}
+	if err != nil {
+		fmt.Printf("Error restoring '%s' (%s)\n", backupfile, err)
+		return 1
+	}
+	fmt.Printf("Restored '%s' to '%s'\n", backupfile, dbfile)
+	return 0
+}
+
+func run_fsck_cmd(dbfile string, fix bool) int {
+	if !file_exists(dbfile) {
+		fmt.Printf("dbfile '%s' doesn't exist.\n", dbfile)
+		return 1
+	}
+	db, err := open_db(dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	defer db.close()
+
+	// Stock pages are needed to check for url collisions.
+	if file_exists(STOCK_PAGES_DIR) {
+		stock_pages = load_stock_pages()
+	} else {
+		fmt.Printf("Stock pages dir '%s' not found, skipping stock page url checks.\n", STOCK_PAGES_DIR)
+	}
+
+	// Only prompt when run from a terminal.
+	interactive := false
+	fi, err := os.Stdin.Stat()
+	if err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+	}
+
+	nleft, err := fsck_db(db, fix, interactive)
+	if err != nil {
+		fmt.Printf("Error checking '%s' (%s)\n", dbfile, err)
+		return 1
+	}
+	if nleft > 0 {
+		return 1
+	}
+	return 0
 }
 
 func load_stock_pages() []StockPage {
@@ -218,27 +601,40 @@ func (server *Server) admin_handler(w http.ResponseWriter, r *http.Request) {
 	}
 	html_print_open(P, r.Host, &HtmlMeta{title: "Page list"})
 	print_header(P)
+
+	// Admin search includes pages opted out of search.
+	q := strings.TrimSpace(r.FormValue("q"))
+	print_search_form(P, "/$$$", q)
+	if q != "" {
+		print_search_results(P, server.db, "/$$$", q, true, atoi(r.FormValue("offset")))
+		html_print_close(P)
+		return
+	}
+
 	P("<p>\n")
 	for _, t := range tt {
-		P("<a href=\"/%s\">%s</a><br>\n", t.url, t.title)
+		pinned := ""
+		if t.pinned {
+			pinned = ", pinned"
+		}
+		P("<a href=\"/%s\">%s</a> (%d views%s)<br>\n", t.url, escape(txtpage_list_title(t)), t.views, pinned)
 	}
 	P("</p>\n")
 	html_print_close(P)
 }
 
+// Pages are served at their (possibly nested) url. Page actions are under
+// /-/<action>/<url> so they can't collide with nested page urls.
 func (server *Server) index_handler(w http.ResponseWriter, r *http.Request) {
-	var url string
-	var action string
-	ss := strings.Split(r.URL.Path, "/")
-	if len(ss) >= 2 {
-		url = ss[1]
-	}
-	if len(ss) >= 3 {
-		action = ss[2]
-	}
+	url := strings.Trim(r.URL.Path, "/")
+	action, actionurl := parse_action_path(url)
 
 	if action == "edit" {
-		server.edit_handler(w, r, url)
+		server.edit_handler(w, r, actionurl)
+	} else if action == "suggest" {
+		server.suggest_handler(w, r, actionurl)
+	} else if action != "" {
+		http.NotFound(w, r)
 	} else if url != "" {
 		server.page_handler(w, r, url)
 	} else {
@@ -261,10 +657,22 @@ func (server *Server) page_handler(w http.ResponseWriter, r *http.Request, url s
 	}
 
 	z = find_txtpage_by_url(server.db, url, &tp)
+	if z == Z_OK && is_txtpage_expired(&tp) {
+		// Expired pages are gone, even before the purge deletes them.
+		z = Z_NOT_FOUND
+	}
+	if z == Z_NOT_FOUND && strings.HasSuffix(url, "/edit") {
+		// Redirect old style /<url>/edit links.
+		http.Redirect(w, r, action_href("edit", strings.TrimSuffix(url, "/edit")), http.StatusMovedPermanently)
+		return
+	}
 	if z == Z_NOT_FOUND {
 		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Not Found"})
 		print_header(P)
-		P("<p>Page not found: %s</p>\n", url)
+		P("<p>Page not found: %s</p>\n", escape(url))
+		if is_url_allowed(url) {
+			P("<p><a href=\"/?url=%s\">Create this page</a></p>\n", qescape(url))
+		}
 		html_print_close(P)
 		return
 	}
@@ -275,8 +683,29 @@ func (server *Server) page_handler(w http.ResponseWriter, r *http.Request, url s
 		html_print_close(P)
 		return
 	}
-	touch_txtpage_by_url(server.db, tp.url)
-	print_txtpage(P, r.Host, &tp)
+	if !server.check_view_access(w, r, &tp) {
+		return
+	}
+	if tp.max_views > 0 && !server.check_burn_view(w, r, &tp) {
+		return
+	}
+	html, err := server.render_txtpage(&tp)
+	if err != nil {
+		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Error"})
+		print_header(P)
+		P("<p>Error converting txtpage: %s</p>\n", err.Error())
+		html_print_close(P)
+		return
+	}
+	server.reads.touch(tp.txtpage_id)
+	pv := PageView{
+		tp:        &tp,
+		html:      html,
+		book:      find_book_nav(server.db, &tp, r.FormValue("book")),
+		tree:      find_page_tree(server.db, &tp),
+		backlinks: find_backlinks(server.db, tp.url),
+	}
+	print_txtpage(P, r.Host, &pv)
 }
 
 func match_stock_page(url string, ss []StockPage) *StockPage {
@@ -288,8 +717,10 @@ func match_stock_page(url string, ss []StockPage) *StockPage {
 	return nil
 }
 
+// Return false if url is under a reserved top level path.
 func is_url_allowed(url string) bool {
-	if url == "$$$" || url == "static" {
+	top := strings.SplitN(url, "/", 2)[0]
+	if top == "$$$" || top == "static" || top == "search" || top == "directory" || top == "tag" || top == "book" || top == "preview" || top == "draft" || top == "paste" || top == ACTION_PREFIX {
 		return false
 	}
 	return true
@@ -299,6 +730,8 @@ func (server *Server) new_handler(w http.ResponseWriter, r *http.Request) {
 	var z Z
 	var tp TxtPage
 	var fvalidate bool
+	var preview string
+	var draft *Draft
 
 	w.Header().Set("Content-Type", "text/html")
 	P := makePrintFunc(w)
@@ -310,8 +743,19 @@ func (server *Server) new_handler(w http.ResponseWriter, r *http.Request) {
 		tp.author = strings.TrimSpace(r.FormValue("author"))
 		tp.url = strings.TrimSpace(r.FormValue("url"))
 		tp.passcode = strings.TrimSpace(r.FormValue("passcode"))
+		tp.searchable = r.FormValue("searchable") != ""
+		tp.listed = r.FormValue("listed") != ""
+		tp.toc = r.FormValue("toc") != ""
+		tp.tags = strings.Join(parse_tags(r.FormValue("tags")), " ")
+		form_view_password(r, &tp)
+		tp.max_views = form_max_views(r)
+		tp.expiry = form_expiry(r)
 
 		for {
+			if r.FormValue("preview") != "" {
+				preview = server.form_preview(&tp)
+				break
+			}
 			if tp.title == "" || tp.content == "" {
 				fvalidate = true
 				break
@@ -321,12 +765,24 @@ func (server *Server) new_handler(w http.ResponseWriter, r *http.Request) {
 				fvalidate = true
 				break
 			}
-			print_save_page_success(P, r.Host, &tp, r)
+			server.gm.commit_page("create", &tp, "")
+			server.cache.invalidate(tp.url)
+			server.clear_draft(r, "")
+			print_save_page_success(P, r.Host, &tp, tp.passcode, r)
 			return
 		}
+		server.save_form_draft(w, r, "", &tp)
+	} else if r.FormValue("url") != "" || r.FormValue("title") != "" {
+		// Create links from missing wiki links fill in url and title.
+		tp.url = sanitize_txtpage_url(r.FormValue("url"))
+		tp.title = strings.TrimSpace(r.FormValue("title"))
+		tp.searchable = true
+	} else {
+		tp.searchable = true
+		draft = server.restore_draft(r, "", &tp)
 	}
 
-	print_create_page_form(P, r.Host, &tp, r.URL.Path, fvalidate, z)
+	print_create_page_form(P, r.Host, &tp, r.URL.Path, fvalidate, z, preview, draft, r.FormValue("new_view_password"))
 }
 
 func (server *Server) edit_handler(w http.ResponseWriter, r *http.Request, url string) {
@@ -334,11 +790,18 @@ func (server *Server) edit_handler(w http.ResponseWriter, r *http.Request, url s
 	var tp TxtPage
 	var passcode string
 	var fvalidate bool
+	var conflict *EditConflict
+	var preview string
+	var draft *Draft
+	var cred *Credential
 
 	w.Header().Set("Content-Type", "text/html")
 	P := makePrintFunc(w)
 
 	z = find_txtpage_by_url(server.db, url, &tp)
+	if z == Z_OK && is_txtpage_expired(&tp) {
+		z = Z_NOT_FOUND
+	}
 	if z == Z_NOT_FOUND {
 		html_print_open(P, r.Host, &HtmlMeta{title: "TxtPage Not Found"})
 		print_header(P)
@@ -354,30 +817,95 @@ func (server *Server) edit_handler(w http.ResponseWriter, r *http.Request, url s
 		return
 	}
 
+	if !server.check_view_access(w, r, &tp) {
+		return
+	}
+	if tp.max_views > 0 && !server.check_burn_edit(w, r, &tp) {
+		return
+	}
+
+	if r.FormValue("section") != "" {
+		server.edit_section_handler(w, r, &tp, atoi(r.FormValue("section")))
+		return
+	}
 	if r.Method == "POST" {
+		if action, _ := suggestion_action(r); action != "" {
+			server.edit_suggestion_handler(w, r, &tp)
+			return
+		}
+		if action, _ := access_action(r); action != "" {
+			server.edit_access_handler(w, r, &tp)
+			return
+		}
+	}
+
+	saved := tp
+	if r.Method == "POST" && r.FormValue("burn_unlock") == "" {
+		oldurl := tp.url
 		tp.title = strings.TrimSpace(r.FormValue("title"))
 		tp.content = strings.TrimSpace(r.FormValue("content"))
 		tp.desc = strings.TrimSpace(r.FormValue("desc"))
 		tp.author = strings.TrimSpace(r.FormValue("author"))
 		tp.url = strings.TrimSpace(r.FormValue("url"))
 		passcode = strings.TrimSpace(r.FormValue("passcode"))
+		tp.searchable = r.FormValue("searchable") != ""
+		tp.listed = r.FormValue("listed") != ""
+		tp.toc = r.FormValue("toc") != ""
+		tp.tags = strings.Join(parse_tags(r.FormValue("tags")), " ")
+		tp.version = int64(atoi(r.FormValue("version")))
+		form_view_password(r, &tp)
+		tp.max_views = form_max_views(r)
+		tp.expiry = form_expiry(r)
+		cred = find_credential(server.db, &saved, passcode)
 
 		for {
-			if tp.title == "" || tp.content == "" || passcode != tp.passcode {
+			if r.FormValue("preview") != "" {
+				preview = server.form_preview(&tp)
+				break
+			}
+			if r.FormValue("review_suggestions") != "" {
+				fvalidate = cred == nil
+				break
+			}
+			if tp.title == "" || tp.content == "" || cred == nil {
+				fvalidate = true
+				break
+			}
+			z = check_edit(cred, &saved, &tp)
+			if z != Z_OK {
+				fvalidate = true
+				break
+			}
+			z = edit_txtpage(server.db, &tp, cred)
+			if z == Z_EDIT_CONFLICT {
+				conflict = server.merge_edit(&tp)
 				fvalidate = true
 				break
 			}
-			z = edit_txtpage(server.db, &tp, passcode)
 			if z != Z_OK {
 				fvalidate = true
 				break
 			}
-			print_save_page_success(P, r.Host, &tp, r)
+			server.gm.commit_page("edit", &tp, oldurl)
+			server.cache.invalidate(tp.url, oldurl)
+			server.clear_draft(r, oldurl)
+			if id := atoi(r.FormValue("suggestion")); id > 0 {
+				delete_suggestion(server.db, int64(id), tp.txtpage_id)
+			}
+			print_save_page_success(P, r.Host, &tp, cred.passcode, r)
 			return
 		}
+		server.save_form_draft(w, r, oldurl, &tp)
+	} else {
+		// The passcode entered to edit a self-destructing page is kept.
+		passcode = strings.TrimSpace(r.FormValue("passcode"))
+		cred = find_credential(server.db, &saved, passcode)
+		draft = server.restore_draft(r, url, &tp)
 	}
 
-	print_edit_page_form(P, r.Host, &tp, r.URL.Path, fvalidate, z, passcode)
+	sv := server.suggestions_view(&saved, cred, int64(atoi(r.FormValue("suggestion"))), "")
+	av := server.access_view(&saved, cred, "")
+	print_edit_page_form(P, r.Host, &tp, r.URL.Path, fvalidate, z, passcode, conflict, preview, draft, sv, av, r.FormValue("new_view_password"))
 }
 
 // print_titlebar(P, "header", "/", "home", "/", "about")
@@ -395,6 +923,8 @@ func print_titlebar(P PrintFunc, classname string, ll ...string) {
 func print_header(P PrintFunc) {
 	P("<div class=\"titlebar header\">\n")
 	P("    <p><a href=\"/\">%s</a> - %s</p>\n", TXTPAGES_NAME, TXTPAGES_SLOGAN)
+	P("    <p><a href=\"/directory\">Directory</a></p>\n")
+	P("    <p><a href=\"/search\">Search</a></p>\n")
 	P("    <p><a href=\"/about\">About</a></p>\n")
 	P("    <p><a href=\"/howto\">How to use</a></p>\n")
 	P("</div>\n")
@@ -402,14 +932,21 @@ func print_header(P PrintFunc) {
 func print_footer(P PrintFunc) {
 	P("<div class=\"titlebar footer\">\n")
 	P("    <p><a href=\"/\">%s</a> - %s</p>\n", TXTPAGES_NAME, TXTPAGES_SLOGAN)
+	P("    <p><a href=\"/directory\">Directory</a></p>\n")
+	P("    <p><a href=\"/search\">Search</a></p>\n")
 	P("    <p><a href=\"/about\">About</a></p>\n")
 	P("    <p><a href=\"/howto\">How to use</a></p>\n")
 	P("</div>\n")
 }
-func print_page_header(P PrintFunc, title string, url string) {
+
+// Only public pages take suggested edits.
+func print_page_header(P PrintFunc, tp *TxtPage) {
 	P("<div class=\"titlebar header\">\n")
-	P("    <h1>%s</h1>\n", title)
-	P("    <p><a href=\"/%s/edit\">Edit</a></p>\n", url)
+	P("    <h1>%s</h1>\n", tp.title)
+	P("    <p><a href=\"%s\">Edit</a></p>\n", action_href("edit", tp.url))
+	if is_public_txtpage(tp) {
+		P("    <p><a href=\"%s\">Suggest an edit</a></p>\n", action_href("suggest", tp.url))
+	}
 	P("</div>\n")
 }
 
@@ -425,29 +962,43 @@ func print_stock_page(P PrintFunc, host string, sp *StockPage) {
 	html_print_close(P)
 }
 
-func print_txtpage(P PrintFunc, host string, tp *TxtPage) {
-	desc := tp.desc
-	if desc == "" {
-		desc = content_to_desc(tp.content)
-	}
+// Txtpage with everything shown around it on its page.
+type PageView struct {
+	tp        *TxtPage
+	html      string
+	book      *BookNav
+	tree      *PageTree
+	backlinks TxtPages
+}
+
+func print_txtpage(P PrintFunc, host string, pv *PageView) {
+	tp := pv.tp
 	m := HtmlMeta{
-		title:       tp.title,
-		description: desc,
-		author:      tp.author,
-		image_urls:  get_image_urls(tp.content),
+		title:   tp.title,
+		author:  tp.author,
+		noindex: tp.view_password != "" || tp.max_views > 0,
 	}
-	html_print_open(P, host, &m)
-	html_str, err := md_to_html(nil, []byte(tp.content))
-	if err != nil {
-		print_header(P)
-		P("<p>Error converting txtpage: %s</p>\n", err.Error())
-		html_print_close(P)
-		return
+	// Encrypted content isn't put in link previews.
+	if !tp.encrypted {
+		m.description = tp.desc
+		if m.description == "" {
+			m.description = content_to_desc(tp.content)
+		}
+		m.image_urls = get_image_urls(tp.content)
 	}
-	print_page_header(P, tp.title, tp.url)
+	html_print_open(P, host, &m)
+	print_breadcrumbs(P, pv.tree)
+	print_page_header(P, tp)
+	print_burn_notice(P, tp)
+	print_txtpage_tags(P, txtpage_tags(tp))
+	print_book_nav_top(P, pv.book)
 	P("<article class=\"txtpage_content\">\n")
-	P("%s\n", html_str)
+	P("%s\n", pv.html)
 	P("</article>\n")
+	print_child_pages(P, pv.tree)
+	print_backlinks(P, pv.backlinks)
+	print_book_nav_bottom(P, pv.book)
+	print_expiry_notice(P, tp)
 	print_footer(P)
 	html_print_close(P)
 }
@@ -473,7 +1024,7 @@ func get_image_urls(md string) []string {
 	return urls
 }
 
-func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath string, fvalidate bool, zresult Z) {
+func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath string, fvalidate bool, zresult Z, preview string, draft *Draft, view_password string) {
 	var errmsg string
 
 	if fvalidate {
@@ -490,12 +1041,14 @@ func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath st
 	html_print_open(P, host, &m)
 	print_header(P)
 	P("<h2>Create a txtpage</h2>\n")
+	P("<p>Or <a href=\"/paste\">create an encrypted paste</a> that only people with its link can read.</p>\n")
 	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", actionpath)
 	if errmsg != "" {
 		P("    <div class=\"txtpage_form_error\">\n")
 		P("        <p>%s</p>\n", errmsg)
 		P("    </div>\n")
 	}
+	print_form_draft(P, tp, "", draft)
 	P("    <div>\n")
 	if fvalidate && tp.title == "" {
 		P("        <label for=\"title\">Please enter a Title</label>\n")
@@ -514,6 +1067,7 @@ func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath st
 		P("        <textarea id=\"content\" name=\"content\" rows=\"20\">%s</textarea>\n", escape(tp.content))
 	}
 	P("    </div>\n")
+	print_form_preview(P, preview)
 	P("    <div>\n")
 	P("        <label for=\"desc\">Description <i>(optional)</i></label>\n")
 	P("        <textarea id=\"desc\" name=\"desc\" rows=\"3\">%s</textarea>\n", escape(tp.desc))
@@ -522,6 +1076,7 @@ func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath st
 	P("        <label for=\"author\">Author <i>(optional)</i></label>\n")
 	P("        <input id=\"author\" name=\"author\" value=\"%s\">\n", escape(tp.author))
 	P("    </div>\n")
+	print_form_tags(P, tp)
 	P("    <div>\n")
 	if fvalidate && zresult == Z_URL_EXISTS {
 		P("        <label for=\"url\">URL already exists, enter another one</label>\n")
@@ -531,18 +1086,27 @@ func print_create_page_form(P PrintFunc, host string, tp *TxtPage, actionpath st
 		P("        <input id=\"url\" name=\"url\" value=\"%s\">\n", escape(tp.url))
 	}
 	P("    </div>\n")
+	print_form_checkbox(P, "searchable", "Include page in search results", tp.searchable)
+	print_form_checkbox(P, "listed", "List this page publicly in the <a href=\"/directory\">directory</a>", tp.listed)
+	print_form_checkbox(P, "toc", "Show a table of contents <i>(or put [TOC] where you want it)</i>", tp.toc)
+	print_form_view_password(P, tp, view_password)
+	print_form_burn(P, tp)
+	print_form_expiry(P, tp)
 	P("    <div>\n")
 	P("        <label for=\"passcode\">Set passcode <i>(optional)</i></label>\n")
 	P("        <input id=\"passcode\" name=\"passcode\" value=\"%s\">\n", escape(tp.passcode))
 	P("    </div>\n")
 	P("    <div class=\"txtpage_form_save\">\n")
 	P("        <button type=\"submit\">Create Page</button>\n")
+	print_form_preview_button(P)
+	print_form_draft_button(P, draft)
 	P("    </div>\n")
 	P("</form>\n")
 	html_print_close(P)
 }
 
-func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath string, fvalidate bool, zresult Z, passcode string) {
+// Pass conflict to show the saved version of the page after an edit conflict.
+func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath string, fvalidate bool, zresult Z, passcode string, conflict *EditConflict, preview string, draft *Draft, sv *SuggestionsView, av *AccessView, view_password string) {
 	var errmsg string
 
 	if fvalidate {
@@ -560,11 +1124,17 @@ func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath stri
 	print_header(P)
 	P("<h2>Edit txtpage</h2>\n")
 	P("<form class=\"txtpage_form\" method=\"post\" action=\"%s\">\n", actionpath)
+	P("    <input type=\"hidden\" name=\"version\" value=\"%d\">\n", tp.version)
 	if errmsg != "" {
 		P("    <div class=\"txtpage_form_error\">\n")
 		P("        <p>%s</p>\n", errmsg)
 		P("    </div>\n")
 	}
+	print_edit_conflict(P, conflict)
+	print_suggestion_notice(P, sv)
+	print_access_notice(P, av)
+	_, page := parse_action_path(strings.TrimPrefix(actionpath, "/"))
+	print_form_draft(P, tp, page, draft)
 	P("    <div>\n")
 	if fvalidate && tp.title == "" {
 		P("        <label for=\"title\">Please enter a Title</label>\n")
@@ -583,6 +1153,7 @@ func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath stri
 		P("        <textarea id=\"content\" name=\"content\" rows=\"20\">%s</textarea>\n", escape(tp.content))
 	}
 	P("    </div>\n")
+	print_form_preview(P, preview)
 	P("    <div>\n")
 	P("        <label for=\"desc\">Description <i>(optional)</i></label>\n")
 	P("        <textarea id=\"desc\" name=\"desc\" rows=\"3\">%s</textarea>\n", escape(tp.desc))
@@ -591,6 +1162,7 @@ func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath stri
 	P("        <label for=\"author\">Author <i>(optional)</i></label>\n")
 	P("        <input id=\"author\" name=\"author\" value=\"%s\">\n", escape(tp.author))
 	P("    </div>\n")
+	print_form_tags(P, tp)
 	P("    <div>\n")
 	if fvalidate && zresult == Z_URL_EXISTS {
 		P("        <label for=\"url\">URL already exists, enter another one</label>\n")
@@ -600,8 +1172,14 @@ func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath stri
 		P("        <input id=\"url\" name=\"url\" value=\"%s\">\n", escape(tp.url))
 	}
 	P("    </div>\n")
+	print_form_checkbox(P, "searchable", "Include page in search results", tp.searchable)
+	print_form_checkbox(P, "listed", "List this page publicly in the <a href=\"/directory\">directory</a>", tp.listed)
+	print_form_checkbox(P, "toc", "Show a table of contents <i>(or put [TOC] where you want it)</i>", tp.toc)
+	print_form_view_password(P, tp, view_password)
+	print_form_burn(P, tp)
+	print_form_expiry(P, tp)
 	P("    <div>\n")
-	if fvalidate && passcode != tp.passcode {
+	if fvalidate && av.cred == nil {
 		P("        <label for=\"passcode\">Incorrect passcode, please re-enter</label>\n")
 		P("        <input id=\"passcode\" class=\"highlight\" autofocus name=\"passcode\" value=\"%s\">\n", escape(passcode))
 	} else {
@@ -611,17 +1189,39 @@ func print_edit_page_form(P PrintFunc, host string, tp *TxtPage, actionpath stri
 	P("    </div>\n")
 	P("    <div class=\"txtpage_form_save\">\n")
 	P("        <button type=\"submit\">Save Page</button>\n")
+	print_form_preview_button(P)
+	print_form_draft_button(P, draft)
 	P("    </div>\n")
+	print_form_suggestions(P, sv)
+	print_form_access(P, tp, av)
 	P("</form>\n")
 	html_print_close(P)
 }
 
-func print_save_page_success(P PrintFunc, host string, tp *TxtPage, r *http.Request) {
+func print_form_tags(P PrintFunc, tp *TxtPage) {
+	P("    <div>\n")
+	P("        <label for=\"tags\">Tags <i>(optional, separate with spaces or commas, or add #hashtags to content)</i></label>\n")
+	P("        <input id=\"tags\" name=\"tags\" value=\"%s\">\n", escape(tp.tags))
+	P("    </div>\n")
+}
+
+func print_form_checkbox(P PrintFunc, name string, label string, checked bool) {
+	var checked_attr string
+	if checked {
+		checked_attr = " checked"
+	}
+	P("    <div class=\"txtpage_form_option\">\n")
+	P("        <label><input type=\"checkbox\" name=\"%s\" value=\"1\"%s> %s</label>\n", name, checked_attr, label)
+	P("    </div>\n")
+}
+
+// passcode is the passcode the page was saved with.
+func print_save_page_success(P PrintFunc, host string, tp *TxtPage, passcode string, r *http.Request) {
 	href_link := fmt.Sprintf("/%s", tp.url)
-	edit_href_link := fmt.Sprintf("/%s/edit", tp.url)
+	edit_href_link := action_href("edit", tp.url)
 
 	page_name := fmt.Sprintf("%s/%s", r.Host, tp.url)
-	edit_page_name := fmt.Sprintf("%s/%s/edit", r.Host, tp.url)
+	edit_page_name := fmt.Sprintf("%s%s", r.Host, edit_href_link)
 
 	html_print_open(P, host, &HtmlMeta{title: "TxtPage Success"})
 	P("<h2>TxtPage created!</h2>\n")
@@ -629,7 +1229,7 @@ func print_save_page_success(P PrintFunc, host string, tp *TxtPage, r *http.Requ
 	P("<a href=\"%s\">%s</a></p>", href_link, page_name)
 	P("<p>Edit your txtpage:<br>\n")
 	P("<a href=\"%s\">%s</a></p>", edit_href_link, edit_page_name)
-	P("<p>Passcode: <strong><i>%s</i></strong></p>\n", tp.passcode)
+	P("<p>Passcode: <strong><i>%s</i></strong></p>\n", escape(passcode))
 	P("<p>Memorize or write down your passcode and keep it somewhere safe.<br>You will need this when making changes to your txtpage.</p>\n")
 	print_footer(P)
 	html_print_close(P)
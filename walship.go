@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// WalShipper copies sqlite WAL frames into a replica directory as soon as
+// they are committed, so the db can be rebuilt at any point in time.
+//
+// The replica is a list of generations. Each generation starts with a raw
+// copy of the db file taken right after a full checkpoint, followed by WAL
+// segments holding every transaction committed since then:
+//
+//	<replicadir>/<gen>/snapshot.db
+//	<replicadir>/<gen>/<seq>-<time>.wal
+//
+// Automatic checkpoints are turned off (see WALSHIP_DRIVER) so that the WAL
+// is only ever reset by the shipper when it starts a new generation.
+type WalShipper struct {
+	db      *DB
+	dbfile  string
+	dir     string
+	gen     string
+	seq     int
+	offset  int64
+	salt    []byte
+	startdt time.Time
+}
+
+// sqlite driver with automatic WAL checkpoints disabled on every connection.
+const WALSHIP_DRIVER = "sqlite3_walship"
+
+const WAL_HEADER_LEN = 32
+const WAL_FRAME_HEADER_LEN = 24
+
+// Start a new generation when the WAL gets this big, or this old.
+const WALSHIP_MAX_WAL_SIZE = 16 * 1024 * 1024
+const WALSHIP_GENERATION_DURATION = 24 * time.Hour
+
+// Number of generations kept in the replica dir.
+const WALSHIP_KEEP_GENERATIONS = 8
+
+const WALSHIP_TIME_FMT = "20060102T150405.000000000Z"
+const WALSHIP_SNAPSHOT = "snapshot.db"
+const WALSHIP_SEGMENT_EXT = ".wal"
+
+func init() {
+	sql.Register(WALSHIP_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA wal_autocheckpoint = 0", nil)
+			return err
+		},
+	})
+}
+
+// Start shipping WAL of db (opened with WALSHIP_DRIVER) into replicadir.
+func start_walshipper(db *DB, dbfile string, replicadir string) (*WalShipper, error) {
+	err := os.MkdirAll(replicadir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ws := &WalShipper{
+		db:     db,
+		dbfile: dbfile,
+		dir:    replicadir,
+	}
+	err = db.exclusive(ws.new_generation)
+	if err != nil {
+		return nil, err
+	}
+	db.on_commit = func() {
+		err := ws.ship()
+		if err != nil {
+			logerr("walshipper", err)
+		}
+	}
+	return ws, nil
+}
+
+// Start a new generation if the current WAL is too big or too old.
+// Called periodically.
+func (ws *WalShipper) check_generation() error {
+	return ws.db.exclusive(func() error {
+		if ws.offset < WALSHIP_MAX_WAL_SIZE && time.Since(ws.startdt) < WALSHIP_GENERATION_DURATION {
+			return nil
+		}
+		return ws.new_generation()
+	})
+}
+
+// Ship what's left of the current generation and start a new one.
+// Must run on the writer goroutine.
+func (ws *WalShipper) new_generation() error {
+	if ws.gen != "" {
+		err := ws.ship()
+		if err != nil {
+			return err
+		}
+	}
+	return ws.snapshot()
+}
+
+// Checkpoint the WAL into the db file and snapshot the db file as the start
+// of a new generation.
+func (ws *WalShipper) snapshot() error {
+	var busy, nlog, ncheckpointed int
+	err := ws.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &nlog, &ncheckpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("wal checkpoint blocked by readers, will retry")
+	}
+
+	now := time.Now().UTC()
+	gen := now.Format(WALSHIP_TIME_FMT)
+	gendir := filepath.Join(ws.dir, gen)
+	err = os.MkdirAll(gendir, 0755)
+	if err != nil {
+		return err
+	}
+	err = copy_file(ws.dbfile, filepath.Join(gendir, WALSHIP_SNAPSHOT))
+	if err != nil {
+		os.RemoveAll(gendir)
+		return err
+	}
+
+	ws.gen = gen
+	ws.seq = 0
+	ws.offset = 0
+	ws.salt = nil
+	ws.startdt = now
+	logprint("walshipper: started generation %s\n", gen)
+
+	return ws.remove_old_generations()
+}
+
+// Copy newly committed WAL frames into a new segment file.
+// Must run on the writer goroutine.
+func (ws *WalShipper) ship() error {
+	f, err := os.Open(ws.dbfile + "-wal")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < WAL_HEADER_LEN {
+		return nil
+	}
+
+	hdr := make([]byte, WAL_HEADER_LEN)
+	_, err = io.ReadFull(f, hdr)
+	if err != nil {
+		return err
+	}
+	pagesize := int64(binary.BigEndian.Uint32(hdr[8:12]))
+	salt := hdr[16:24]
+	if ws.salt != nil && !bytes.Equal(salt, ws.salt) {
+		// WAL was reset behind our back. The frames we shipped no longer
+		// line up with it, so start over from a fresh snapshot.
+		return ws.snapshot()
+	}
+
+	// Find end of last commit frame belonging to the current WAL.
+	start := ws.offset
+	if start == 0 {
+		start = WAL_HEADER_LEN
+	}
+	end := start
+	framelen := WAL_FRAME_HEADER_LEN + pagesize
+	fh := make([]byte, WAL_FRAME_HEADER_LEN)
+	for pos := start; pos+framelen <= fi.Size(); pos += framelen {
+		_, err = f.ReadAt(fh, pos)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(fh[8:16], salt) {
+			break
+		}
+		// Nonzero db size marks a commit frame.
+		if binary.BigEndian.Uint32(fh[4:8]) != 0 {
+			end = pos + framelen
+		}
+	}
+	if end == start {
+		return nil
+	}
+
+	// First segment of a WAL includes the WAL header.
+	from := ws.offset
+	buf := make([]byte, end-from)
+	_, err = f.ReadAt(buf, from)
+	if err != nil {
+		return err
+	}
+
+	segfile := filepath.Join(ws.dir, ws.gen, fmt.Sprintf("%08d-%s%s", ws.seq, time.Now().UTC().Format(WALSHIP_TIME_FMT), WALSHIP_SEGMENT_EXT))
+	err = write_file_sync(segfile, buf)
+	if err != nil {
+		return err
+	}
+
+	ws.seq++
+	ws.offset = end
+	ws.salt = append([]byte{}, salt...)
+	return nil
+}
+
+func write_file_sync(file string, bs []byte) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Return generation names in replicadir, oldest first.
+func list_generations(replicadir string) ([]string, error) {
+	ee, err := os.ReadDir(replicadir)
+	if err != nil {
+		return nil, err
+	}
+	gg := []string{}
+	for _, e := range ee {
+		if !e.IsDir() {
+			continue
+		}
+		_, err := time.Parse(WALSHIP_TIME_FMT, e.Name())
+		if err != nil {
+			continue
+		}
+		if !file_exists(filepath.Join(replicadir, e.Name(), WALSHIP_SNAPSHOT)) {
+			continue
+		}
+		gg = append(gg, e.Name())
+	}
+	sort.Strings(gg)
+	return gg, nil
+}
+
+func (ws *WalShipper) remove_old_generations() error {
+	gg, err := list_generations(ws.dir)
+	if err != nil {
+		return err
+	}
+	for len(gg) > WALSHIP_KEEP_GENERATIONS {
+		logprint("walshipper: removing generation %s\n", gg[0])
+		err = os.RemoveAll(filepath.Join(ws.dir, gg[0]))
+		if err != nil {
+			return err
+		}
+		gg = gg[1:]
+	}
+	return nil
+}
+
+type WalSegment struct {
+	file string
+	seq  int
+	t    time.Time
+}
+
+// Return WAL segments of generation dir, in order.
+func list_segments(gendir string) ([]WalSegment, error) {
+	ff, err := filepath.Glob(filepath.Join(gendir, "*"+WALSHIP_SEGMENT_EXT))
+	if err != nil {
+		return nil, err
+	}
+	segs := []WalSegment{}
+	for _, f := range ff {
+		name := strings.TrimSuffix(filepath.Base(f), WALSHIP_SEGMENT_EXT)
+		ss := strings.SplitN(name, "-", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		t, err := time.Parse(WALSHIP_TIME_FMT, ss[1])
+		if err != nil {
+			continue
+		}
+		segs = append(segs, WalSegment{file: f, seq: atoi(ss[0]), t: t})
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].seq < segs[j].seq
+	})
+	return segs, nil
+}
+
+// Rebuild db as it was at time t from the replica dir and write it to
+// dbfile. Any existing dbfile is renamed to dbfile.bak first.
+func restore_replica(replicadir string, t time.Time, dbfile string) error {
+	err := check_db_bak(dbfile)
+	if err != nil {
+		return err
+	}
+	gg, err := list_generations(replicadir)
+	if err != nil {
+		return err
+	}
+
+	// Use latest generation started at or before t.
+	gen := ""
+	for _, g := range gg {
+		gt, _ := time.Parse(WALSHIP_TIME_FMT, g)
+		if gt.After(t) {
+			break
+		}
+		gen = g
+	}
+	if gen == "" {
+		return fmt.Errorf("no replica generation in '%s' at or before %s", replicadir, t.Format(time.RFC3339))
+	}
+	gendir := filepath.Join(replicadir, gen)
+
+	tmpfile := dbfile + ".restore"
+	os.Remove(tmpfile + "-wal")
+	os.Remove(tmpfile + "-shm")
+	err = copy_file(filepath.Join(gendir, WALSHIP_SNAPSHOT), tmpfile)
+	if err != nil {
+		return err
+	}
+
+	// Concatenate segments committed up to t into a WAL file next to the
+	// snapshot. sqlite replays it when the db is opened.
+	segs, err := list_segments(gendir)
+	if err != nil {
+		return err
+	}
+	var wal bytes.Buffer
+	for i, seg := range segs {
+		if seg.t.After(t) || seg.seq != i {
+			break
+		}
+		bs, err := os.ReadFile(seg.file)
+		if err != nil {
+			return err
+		}
+		wal.Write(bs)
+	}
+	if wal.Len() > 0 {
+		err = os.WriteFile(tmpfile+"-wal", wal.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Apply the WAL into the db file.
+	db, err := sql.Open("sqlite3", tmpfile)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	db.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(tmpfile + "-wal")
+	os.Remove(tmpfile + "-shm")
+
+	err = integrity_check_file(tmpfile)
+	if err != nil {
+		return err
+	}
+
+	err = move_db_to_bak(dbfile)
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return os.Rename(tmpfile, dbfile)
+}
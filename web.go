@@ -12,8 +12,10 @@ import (
 	"strings"
 
 	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
 )
 
 type HtmlMeta struct {
@@ -22,6 +24,13 @@ type HtmlMeta struct {
 	author      string
 	url         string
 	image_urls  []string
+	noindex     bool
+}
+
+type MdHeading struct {
+	level int
+	id    string
+	text  string
 }
 
 type PrintFunc func(format string, a ...interface{}) (n int, err error)
@@ -105,6 +114,9 @@ func html_print_open(P PrintFunc, host string, m *HtmlMeta) {
 	if m.author != "" {
 		P("<meta name=\"author\" content=\"%s\">\n", escape(m.author))
 	}
+	if m.noindex {
+		P("<meta name=\"robots\" content=\"noindex\">\n")
+	}
 
 	P("<meta property=\"og:type\" content=\"website\">\n")
 	P("<meta property=\"og:title\" content=\"%s\">\n", escape(title))
@@ -177,9 +189,27 @@ func readCookie(r *http.Request, name string) string {
 	return c.Value
 }
 
-func create_goldmark_interface() goldmark.Markdown {
+// Page rendering options. A nil *MdOptions renders plain markdown.
+type MdOptions struct {
+	// Render [[wiki links]] to missing pages as create links.
+	resolve WikiLinkResolver
+
+	// Add an edit link to top level heading i, except headings within
+	// source ranges of included pages.
+	section_href func(i int) string
+	included     [][2]int
+}
+
+func create_goldmark_interface(opts *MdOptions) goldmark.Markdown {
+	if opts == nil {
+		opts = &MdOptions{}
+	}
 	return goldmark.New(
-		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithExtensions(
+			extension.GFM,
+			&WikiLinks{resolve: opts.resolve},
+			&TocExtension{section_href: opts.section_href, included: opts.included},
+		),
 		goldmark.WithParserOptions(
 			parser.WithAutoHeadingID(),
 		),
@@ -189,7 +219,7 @@ func create_goldmark_interface() goldmark.Markdown {
 
 func md_to_html(gmd goldmark.Markdown, markdown_bytes []byte) (string, error) {
 	if gmd == nil {
-		gmd = create_goldmark_interface()
+		gmd = create_goldmark_interface(nil)
 	}
 	var buf bytes.Buffer
 	err := gmd.Convert(markdown_bytes, &buf)
@@ -199,6 +229,58 @@ func md_to_html(gmd goldmark.Markdown, markdown_bytes []byte) (string, error) {
 	return buf.String(), nil
 }
 
+// Return headings in markdown, with the ids generated for them by
+// parser.WithAutoHeadingID().
+func md_headings(gmd goldmark.Markdown, markdown_bytes []byte) []MdHeading {
+	if gmd == nil {
+		gmd = create_goldmark_interface(nil)
+	}
+	doc := gmd.Parser().Parse(text.NewReader(markdown_bytes))
+
+	hh := []MdHeading{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		heading, ok := n.(*ast.Heading)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		h := MdHeading{level: heading.Level}
+		id, ok := heading.AttributeString("id")
+		if ok {
+			if bs, ok := id.([]byte); ok {
+				h.id = string(bs)
+			}
+		}
+		h.text = md_node_text(heading, markdown_bytes)
+		hh = append(hh, h)
+		return ast.WalkSkipChildren, nil
+	})
+	return hh
+}
+
+// Return plain text of node's inline children.
+func md_node_text(n ast.Node, source []byte) string {
+	var b strings.Builder
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch t := c.(type) {
+		case *ast.Text:
+			b.Write(t.Segment.Value(source))
+			if t.SoftLineBreak() {
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.Write(t.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return b.String()
+}
+
 // Returns the full absolute url:
 // Given path = "/static/typewriter.png"
 // Returns: "https://txtpages.xyz/static/typewriter.png"
@@ -216,3 +298,64 @@ func absolute_url(host string, path string) string {
 func logo_absolute_url(host string) string {
 	return absolute_url(host, "/static/typewriter.png")
 }
+
+// Top level heading with the offset of the start of its line in source.
+type MdHeadingPos struct {
+	level int
+	id    string
+	start int
+}
+
+// Return top level headings of markdown in order, with their positions.
+func md_heading_positions(gmd goldmark.Markdown, markdown_bytes []byte) []MdHeadingPos {
+	if gmd == nil {
+		gmd = create_goldmark_interface(nil)
+	}
+	doc := gmd.Parser().Parse(text.NewReader(markdown_bytes))
+
+	hh := []MdHeadingPos{}
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		heading, ok := n.(*ast.Heading)
+		if !ok || heading.Lines().Len() == 0 {
+			continue
+		}
+		h := MdHeadingPos{level: heading.Level, start: md_line_start(markdown_bytes, heading.Lines().At(0).Start)}
+		id, ok := heading.AttributeString("id")
+		if bs, isbytes := id.([]byte); ok && isbytes {
+			h.id = string(bs)
+		}
+		hh = append(hh, h)
+	}
+	return hh
+}
+
+// Back up from pos to the start of its line.
+func md_line_start(source []byte, pos int) int {
+	for pos > 0 && source[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+// Return start and end offsets of the section under heading hh[i], which
+// runs up to the next heading of the same or higher level.
+func md_section_bounds(hh []MdHeadingPos, i int, srclen int) (int, int) {
+	for j := i + 1; j < len(hh); j++ {
+		if hh[j].level <= hh[i].level {
+			return hh[i].start, hh[j].start
+		}
+	}
+	return hh[i].start, srclen
+}
+
+// Return markdown source of the section under the top level heading with id.
+func md_section(gmd goldmark.Markdown, markdown_bytes []byte, id string) (string, bool) {
+	hh := md_heading_positions(gmd, markdown_bytes)
+	for i, h := range hh {
+		if h.id == id {
+			start, end := md_section_bounds(hh, i, len(markdown_bytes))
+			return string(markdown_bytes[start:end]), true
+		}
+	}
+	return "", false
+}
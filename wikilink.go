@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Resolve wiki link target to a page url and whether the page exists.
+type WikiLinkResolver func(target string) (url string, exists bool)
+
+// [[target]] or [[target|label]] link node.
+type WikiLink struct {
+	ast.BaseInline
+	target []byte
+	label  []byte
+}
+
+var KindWikiLink = ast.NewNodeKind("WikiLink")
+
+func (n *WikiLink) Kind() ast.NodeKind {
+	return KindWikiLink
+}
+
+func (n *WikiLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{
+		"target": string(n.target),
+		"label":  string(n.label),
+	}, nil)
+}
+
+type wikiLinkParser struct{}
+
+func (p *wikiLinkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (p *wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if !bytes.HasPrefix(line, []byte("[[")) {
+		return nil
+	}
+	end := bytes.Index(line, []byte("]]"))
+	if end < 0 {
+		return nil
+	}
+	inner := line[2:end]
+	if bytes.ContainsAny(inner, "[]\n") {
+		return nil
+	}
+	target, label, found := bytes.Cut(inner, []byte("|"))
+	target = bytes.TrimSpace(target)
+	label = bytes.TrimSpace(label)
+	if len(target) == 0 {
+		return nil
+	}
+	if !found || len(label) == 0 {
+		label = target
+	}
+	block.Advance(end + 2)
+	return &WikiLink{
+		target: append([]byte{}, target...),
+		label:  append([]byte{}, label...),
+	}
+}
+
+type wikiLinkRenderer struct {
+	resolve WikiLinkResolver
+}
+
+func (r *wikiLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindWikiLink, r.render)
+}
+
+// Links to missing pages go to the new page form with url and title filled in.
+func (r *wikiLinkRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	wl := n.(*WikiLink)
+	url := string(wl.target)
+	exists := true
+	if r.resolve != nil {
+		url, exists = r.resolve(url)
+	}
+	label := string(wl.label)
+	if exists {
+		w.WriteString("<a class=\"wikilink\" href=\"/" + escape(url) + "\">" + escape(label) + "</a>")
+	} else {
+		href := "/?url=" + qescape(url) + "&title=" + qescape(label)
+		w.WriteString("<a class=\"wikilink wikilink_missing\" href=\"" + escape(href) + "\" title=\"Create this page\">" + escape(label) + "</a>")
+	}
+	return ast.WalkContinue, nil
+}
+
+// Goldmark extension for [[wiki links]]. If resolve is nil, targets are
+// used as page urls as is and all pages are assumed to exist.
+type WikiLinks struct {
+	resolve WikiLinkResolver
+}
+
+func (e *WikiLinks) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(&wikiLinkParser{}, 199),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&wikiLinkRenderer{resolve: e.resolve}, 500),
+	))
+}
+
+// Return targets of all wiki links in markdown, without duplicates.
+func md_wikilinks(gmd goldmark.Markdown, markdown_bytes []byte) []string {
+	if gmd == nil {
+		gmd = create_goldmark_interface(nil)
+	}
+	doc := gmd.Parser().Parse(text.NewReader(markdown_bytes))
+
+	targets := []string{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		wl, ok := n.(*WikiLink)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		target := strings.TrimSpace(string(wl.target))
+		if !ss_contains(targets, target) {
+			targets = append(targets, target)
+		}
+		return ast.WalkContinue, nil
+	})
+	return targets
+}